@@ -3,6 +3,7 @@ package apihelper
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,18 +33,36 @@ var (
 var (
 	ErrSharedDomainNotFound = errors.New("shared domain not found")
 )
+var (
+	ErrDomainNotFound = errors.New("shared or private domain not found")
+)
 var (
 	ErrManagedServiceNotFound = errors.New("managed service not found")
 )
 var (
 	ErrManagedServicePlanNotFound = errors.New("managed service plan not found")
 )
+var (
+	ErrIsolationSegmentNotFound = errors.New("isolation segment not found")
+)
+var (
+	ErrProcessNotFound = errors.New("process type not found")
+)
 
 //Organization representation
 type Organization struct {
+	Guid      string
 	Name      string
 	QuotaGUID  string
 	SpacesURL string
+	Foundation string
+	Metadata  Metadata
+}
+
+//Metadata representation of v3 labels and annotations
+type Metadata struct {
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 //Space representation
@@ -53,6 +72,9 @@ type Space struct {
 	SummaryURL 				string
 	SecurityGroupURL		string
 	StagingSecurityGroupURL	string
+	SpaceQuotaGUID			string
+	AllowSsh				bool
+	Metadata				Metadata
 }
 
 //App representation
@@ -71,17 +93,95 @@ type App struct {
 	EnableSsh               bool
 	EnviornmentVar          map[string]interface{}
 	ServiceNames            []interface{}
-	URLs                    []interface{}
+	Ports                   []float64
+	Routes                  Routes
+	Buildpacks              []string
+	DetectedBuildpack       string
+	BuildpackVersion        string
+	Stack                   string
+	DockerImage             string
+	DockerUsername          string
+	DockerPassword          string
+	Processes               Processes
+	Sidecars                Sidecars
+	Metadata                Metadata
+	ServiceBindings         ServiceBindings
+}
+
+//ServiceBinding representation of the binding of an app to a service instance
+type ServiceBinding struct {
+	InstanceName string
+	Name         string
+	Parameters   map[string]interface{}
+	VolumeMounts []VolumeMount
+}
+
+//VolumeMount representation of a volume service mount, Mode is "r" or "rw"
+type VolumeMount struct {
+	ContainerDir string
+	Mode         string
+	DeviceType   string
+}
+
+//Sidecar representation, Memory 0 means the sidecar shares the process memory
+type Sidecar struct {
+	Name         string
+	Command      string
+	ProcessTypes []string
+	Memory       float64
+}
+
+//Process representation of a v3 app process type
+type Process struct {
+	Type                         string
+	Command                      string
+	Instances                    float64
+	Memory                       float64
+	DiskQuota                    float64
+	HealthCheckType              string
+	HealthCheckTimeout           float64
+	HealthCheckInvocationTimeout float64
+	HealthCheckHttpEndpoint      string
+}
+
+//Route representation, Port is only set for TCP routes and AppPort 0 means the app's default port
+type Route struct {
+	Host        string
+	Domain      string
+	Path        string
+	Port        float64
+	AppPort     float64
+	RouterGroup string
 }
 
 //Service representation
 type Service struct {
-	InstanceName string
-	Label        string
-	ServicePlan  string
-	Type         string
-	Credentials  map[string]interface{}
-	SyslogDrain  string
+	Guid            string
+	InstanceName    string
+	Label           string
+	ServicePlan     string
+	Type            string
+	Credentials     map[string]interface{}
+	SyslogDrain     string
+	RouteServiceURL string
+	Routes          Routes
+	Tags            []string
+	Parameters      map[string]interface{}
+	ServiceKeys     ServiceKeys
+	Metadata        Metadata
+	SharedFrom      SpaceRef
+	SharedTo        []SpaceRef
+}
+
+//SpaceRef identifies a space by org and space name, it is empty for an instance owned by the space
+type SpaceRef struct {
+	Org   string
+	Space string
+}
+
+type ServiceKey struct {
+	Name       string
+	Parameters map[string]interface{}
 }
 
 type Quota struct {
@@ -99,6 +199,51 @@ type Quota struct {
 	TotalReservedRoutePorts	float64
 }
 
+type SpaceQuota struct {
+	Name 					string
+	NonBasicServicesAllowed	bool
+	TotalServices			float64
+	TotalRoutes				float64
+	MemoryLimit				float64
+	InstanceMemoryLimit		float64
+	AppInstanceLimit		float64
+	AppTaskLimit			float64
+	TotalServiceKeys		float64
+	TotalReservedRoutePorts	float64
+}
+
+type NetworkPolicy struct {
+	SourceGuid		string
+	DestinationGuid	string
+	Protocol		string
+	StartPort		float64
+	EndPort			float64
+}
+
+//ServiceBroker representation of a space scoped broker, the password is not exported
+type ServiceBroker struct {
+	Name     string
+	URL      string
+	Username string
+}
+
+//PlanVisibility representation of a service plan made visible to an org
+type PlanVisibility struct {
+	Service string
+	Plan    string
+}
+
+type PrivateDomain struct {
+	Name				string
+	OwningOrganization	string
+}
+
+type Role struct {
+	Type		string
+	Username	string
+	Origin		string
+}
+
 type SecurityGroup	struct {
 	Name			string
 	Rules			Rules
@@ -114,8 +259,38 @@ type Rule struct {
 	Protocol		string
 }
 
+//PlatformConfig representation of the foundation wide configuration outside any org
+type PlatformConfig struct {
+	FeatureFlags                map[string]bool
+	RunningEnvironmentVariables map[string]interface{}
+	StagingEnvironmentVariables map[string]interface{}
+}
+
+//Buildpack representation of an admin buildpack, Filename is empty when no bits were uploaded
+type Buildpack struct {
+	Guid     string
+	Name     string
+	Position float64
+	Stack    string
+	Enabled  bool
+	Locked   bool
+	Filename string
+}
+
 type Orgs []Organization
+type ServiceBrokers []ServiceBroker
+type PlanVisibilities []PlanVisibility
+type Buildpacks []Buildpack
 type Quotas map[string]Quota
+type SpaceQuotas map[string]SpaceQuota
+type NetworkPolicies []NetworkPolicy
+type PrivateDomains []PrivateDomain
+type Processes []Process
+type Sidecars []Sidecar
+type ServiceBindings []ServiceBinding
+type Routes []Route
+type ServiceKeys []ServiceKey
+type Roles []Role
 type Rules	[]Rule
 type SecurityGroups	[]SecurityGroup
 type Spaces []Space
@@ -123,29 +298,75 @@ type Apps []App
 type Services []Service
 
 type ImportedOrg struct {
-	Guid   string
-	Name   string
-	Spaces ISpaces
+	Guid    string
+	Name    string
+	Created bool
+	Spaces  ISpaces
 }
 
 type ImportedSpace struct {
 	Guid     string
 	Name     string
+	Created  bool
 	Apps     IApps
 	Services IServices
 }
 
 type ImportedApp struct {
-	Guid    	string
-	Name    	string
-	Droplet 	string
-	Src     	string
-	OrgState	string
+	Guid    			string
+	Name    			string
+	Droplet 			string
+	Src     			string
+	OrgState			string
+	Docker				bool
+	Created				bool
+	DeferredServices	[]string
+	FailedServices		[]string
 }
 
 type ImportedService struct {
-	Guid string
-	Name string
+	Guid    string
+	Name    string
+	State   string
+	Created bool
+}
+
+type ImportedQuota struct {
+	Guid   string
+	Name   string
+	Action string
+	Quota  Quota
+}
+
+type ImportedServiceKey struct {
+	Guid        string
+	Name        string
+	Credentials map[string]interface{}
+}
+
+type ImportedDomain struct {
+	Guid   string
+	Name   string
+	Action string
+}
+
+type ImportedSecurityGroup struct {
+	Guid   string
+	Name   string
+	Action string
+}
+
+type ImportedServiceBroker struct {
+	Guid   string
+	Name   string
+	Action string
+}
+
+type ImportedBuildpack struct {
+	Guid   string
+	Name   string
+	Stack  string
+	Action string
 }
 
 type IServices []ImportedService
@@ -182,6 +403,19 @@ type CFAPIHelper interface {
 	GetDomainGuid(name string) (string, error)
 	GetServiceInstanceGuid(name string, stype string, spaceguid string) (string, error)
 	GetOrgQuota() (Quotas, error)
+	GetSpaceQuotas(orgguid string) (SpaceQuotas, error)
+	GetOrgRoles(orgguid string) (Roles, error)
+	GetOrgPrivateDomains(orgguid string) (PrivateDomains, error)
+	GetOrgIsolationSegments(orgguid string) ([]string, string, error)
+	GetOrgPlanVisibilities(orgguid string) (PlanVisibilities, error)
+	GetSpaceServiceBrokers(spaceguid string) (ServiceBrokers, error)
+	GetSpaceIsolationSegment(spaceguid string) (string, error)
+	GetIsolationSegmentGuid(name string) (string, error)
+	GetNetworkPolicies() (NetworkPolicies, error)
+	IsAdmin() bool
+	GetPlatformConfig() (PlatformConfig, error)
+	GetBuildpacks() (Buildpacks, error)
+	GetSpaceRoles(spaceguid string) (Roles, error)
 	GetSecurityGroups() (map[string]SecurityGroup, error)
 	GetQuotaMemoryLimit(string) (float64, error)
 	GetOrgSpaces(string) (Spaces, error)
@@ -189,19 +423,49 @@ type CFAPIHelper interface {
 	GetBlob(orgname string, spacename string, blobURL string, filename string, swg *sizedwaitgroup.SizedWaitGroup)
 	PutBlob(blobURL string, filename string, swg *sizedwaitgroup.SizedWaitGroup)
 	CheckOrg(name string, create bool) (ImportedOrg, error)
-	CheckSpace(name string, orgguid string, create bool) (ImportedSpace, error)
+	CheckSpace(name string, orgguid string, allowSsh *bool, create bool) (ImportedSpace, error)
+	IsSSHEnabled() bool
+	CheckQuota(quota Quota, create bool) (ImportedQuota, error)
+	AssignOrgQuota(orgguid string, quotaguid string) error
+	CheckSpaceQuota(quota SpaceQuota, orgguid string, create bool) (ImportedQuota, error)
+	AssignRole(role Role, orgguid string, spaceguid string) (string, error)
+	CheckPrivateDomain(name string, orgguid string, create bool) (ImportedDomain, error)
+	SharePrivateDomain(domainguid string, orgguid string) error
+	EntitleIsolationSegment(segmentguid string, orgguid string) error
+	AssignIsolationSegment(segmentguid string, orgguid string, spaceguid string) error
+	CheckBuildpack(buildpack Buildpack, create bool) (ImportedBuildpack, error)
+	CheckServiceBroker(broker ServiceBroker, password string, spaceguid string, create bool) (ImportedServiceBroker, error)
+	AddPlanVisibility(visibility PlanVisibility, orgguid string) (string, error)
+	UploadBuildpack(buildpackguid string, filename string) error
+	LockBuildpack(buildpackguid string) error
+	AssignSpaceQuota(quotaguid string, spaceguid string) error
+	CheckSecurityGroup(sg SecurityGroup, update bool) (ImportedSecurityGroup, error)
+	BindSecurityGroup(sgguid string, spaceguid string, staging bool) error
+	SetDefaultSecurityGroup(sgguid string, staging bool) error
 	CheckApp(mapp App, rservices IServices, spaceguid string, create bool) (ImportedApp, error)
 	StartApp(appguid string) (error)
 	CheckServiceInstance(service Service, spaceguid string, create bool) (ImportedService, error)
+	BindRouteService(siguid string, stype string, route Route, spaceguid string) error
+	CheckServiceKey(key ServiceKey, siguid string, create bool) (ImportedServiceKey, error)
+	WaitForServiceInstance(siguid string, deadline time.Time) (string, error)
+	BindService(siguid string, appguid string, binding ServiceBinding) error
+	ShareServiceInstance(siguid string, spaceguid string) (string, error)
+	CreateNetworkPolicies(policies NetworkPolicies) error
+	WaitForDroplet(appguid string, deadline time.Time) error
+	ScaleProcess(appguid string, process Process) error
+	SetMetadata(resourceURL string, metadata Metadata) error
+	SetFeatureFlag(name string, enabled bool) error
+	SetEnvironmentVariableGroup(group string, vars map[string]interface{}) error
 }
 
 //APIHelper implementation
 type APIHelper struct {
-	cli plugin.CliConnection
+	cli          plugin.CliConnection
+	routerGroups map[string]string
 }
 
 func New(cli plugin.CliConnection) CFAPIHelper {
-	return &APIHelper{cli}
+	return &APIHelper{cli: cli}
 }
 
 //GetOrgs returns a struct that represents critical fields in the JSON
@@ -211,6 +475,7 @@ func (api *APIHelper) GetOrgs() (Orgs, error) {
 		return nil, err
 	}
 	pages := int(orgsJSON["total_pages"].(float64))
+	foundation, _ := api.cli.ApiEndpoint()
 	orgs := []Organization{}
 	for i := 1; i <= pages; i++ {
 		if 1 != i {
@@ -223,11 +488,16 @@ func (api *APIHelper) GetOrgs() (Orgs, error) {
 			if name == "system" || name == "p-spring-cloud-services" {
 				continue
 			}
+			metadata := theOrg["metadata"].(map[string]interface{})
+			guid := metadata["guid"].(string)
 			orgs = append(orgs,
 				Organization{
-					Name:      name,
-					QuotaGUID: entity["quota_definition_guid"].(string),
-					SpacesURL: entity["spaces_url"].(string),
+					Guid:       guid,
+					Name:       name,
+					QuotaGUID:  entity["quota_definition_guid"].(string),
+					SpacesURL:  entity["spaces_url"].(string),
+					Foundation: foundation,
+					Metadata:   getMetadata(api, "/v3/organizations/"+guid),
 				})
 		}
 	}
@@ -256,34 +526,43 @@ func (api *APIHelper) GetOrg(name string) (Organization, error) {
 
 func (api *APIHelper) orgResourceToOrg(o interface{}) Organization {
 	theOrg := o.(map[string]interface{})
+	metadata := theOrg["metadata"].(map[string]interface{})
 	entity := theOrg["entity"].(map[string]interface{})
+	guid := metadata["guid"].(string)
+	foundation, _ := api.cli.ApiEndpoint()
 	return Organization{
-		Name:      entity["name"].(string),
-		QuotaGUID: entity["quota_definition_guid"].(string),
-		SpacesURL: entity["spaces_url"].(string),
+		Guid:       guid,
+		Name:       entity["name"].(string),
+		QuotaGUID:  entity["quota_definition_guid"].(string),
+		SpacesURL:  entity["spaces_url"].(string),
+		Foundation: foundation,
+		Metadata:   getMetadata(api, "/v3/organizations/"+guid),
 	}
 }
 
-//GetDomainGuid returns a shared domain guid
+//GetDomainGuid returns a shared or private domain guid
 func (api *APIHelper) GetDomainGuid(name string) (string, error) {
 	query := fmt.Sprintf("name:%s", name)
-	path := fmt.Sprintf("/v2/shared_domains?q=%s", url.QueryEscape(query))
-	domainJSON, err := cfcurl.Curl(api.cli, path)
-	if nil != err {
-		return "", err
-	}
+	for _, domainsURL := range []string{"/v2/shared_domains", "/v2/private_domains"} {
+		path := fmt.Sprintf(domainsURL+"?q=%s", url.QueryEscape(query))
+		domainJSON, err := cfcurl.Curl(api.cli, path)
+		if nil != err {
+			return "", err
+		}
 
-	results := int(domainJSON["total_results"].(float64))
-	if results == 0 {
-		return "", ErrSharedDomainNotFound
-	}
+		results := int(domainJSON["total_results"].(float64))
+		if results == 0 {
+			continue
+		}
 
-	domainResource := domainJSON["resources"].([]interface{})[0]
-	theDomain := domainResource.(map[string]interface{})
-	metadata := theDomain["metadata"].(map[string]interface{})
-	guid := metadata["guid"].(string)
+		domainResource := domainJSON["resources"].([]interface{})[0]
+		theDomain := domainResource.(map[string]interface{})
+		metadata := theDomain["metadata"].(map[string]interface{})
+		guid := metadata["guid"].(string)
 
-	return guid, nil
+		return guid, nil
+	}
+	return "", ErrDomainNotFound
 }
 
 //GetServiceInstanceGuid returns a service instance guid
@@ -327,21 +606,7 @@ func (api *APIHelper) GetOrgQuota() (Quotas, error) {
 			theQuota := s.(map[string]interface{})
 			metadata := theQuota["metadata"].(map[string]interface{})
 			entity := theQuota["entity"].(map[string]interface{})
-			quotas[metadata["guid"].(string)] =
-				Quota{
-					Name:       				entity["name"].(string),
-					NonBasicServicesAllowed:	entity["non_basic_services_allowed"].(bool),
-					TotalServices:				entity["total_services"].(float64),
-					TotalRoutes:				entity["total_routes"].(float64),
-					TotalPrivateDomain:			entity["total_private_domains"].(float64),
-					MemoryLimit:				entity["memory_limit"].(float64),
-					TrialDBAllowed:				entity["trial_db_allowed"].(bool),
-					InstanceMemoryLimit:		entity["instance_memory_limit"].(float64),
-					AppInstanceLimit:			entity["app_instance_limit"].(float64),
-					AppTaskLimit:				entity["app_task_limit"].(float64),
-					TotalServiceKeys:			entity["total_service_keys"].(float64),
-					TotalReservedRoutePorts:	entity["total_reserved_route_ports"].(float64),
-				}
+			quotas[metadata["guid"].(string)] = quotaEntityToQuota(entity)
 		}
 		if next, ok := quotasJSON["next_url"].(string); ok {
 			nextURL = next
@@ -352,182 +617,674 @@ func (api *APIHelper) GetOrgQuota() (Quotas, error) {
 	return quotas, nil
 }
 
-//GetSecurityGroups returns SecurityGroups
-func (api *APIHelper) GetSecurityGroups() (map[string]SecurityGroup, error) {
-	nextURL := "/v2/security_groups"
-	securitygroups := make(map[string]SecurityGroup)
+func quotaEntityToQuota(entity map[string]interface{}) Quota {
+	return Quota{
+		Name:       				entity["name"].(string),
+		NonBasicServicesAllowed:	entity["non_basic_services_allowed"].(bool),
+		TotalServices:				entity["total_services"].(float64),
+		TotalRoutes:				entity["total_routes"].(float64),
+		TotalPrivateDomain:			entity["total_private_domains"].(float64),
+		MemoryLimit:				entity["memory_limit"].(float64),
+		TrialDBAllowed:				entity["trial_db_allowed"].(bool),
+		InstanceMemoryLimit:		entity["instance_memory_limit"].(float64),
+		AppInstanceLimit:			entity["app_instance_limit"].(float64),
+		AppTaskLimit:				entity["app_task_limit"].(float64),
+		TotalServiceKeys:			entity["total_service_keys"].(float64),
+		TotalReservedRoutePorts:	entity["total_reserved_route_ports"].(float64),
+	}
+}
+
+//GetSpaceQuotas returns the space quota definitions of an org
+func (api *APIHelper) GetSpaceQuotas(orgguid string) (SpaceQuotas, error) {
+	nextURL := "/v2/organizations/" + orgguid + "/space_quota_definitions"
+	quotas := make(SpaceQuotas)
 	for nextURL != "" {
-		securitygroupsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		quotasJSON, err := cfcurl.Curl(api.cli, nextURL)
 		if nil != err {
 			return nil, err
 		}
-		for _, s := range securitygroupsJSON["resources"].([]interface{}) {
-			theSecurityGroup := s.(map[string]interface{})
-			metadata := theSecurityGroup["metadata"].(map[string]interface{})
-			entity := theSecurityGroup["entity"].(map[string]interface{})
-			rules := make(Rules, len(entity["rules"].([]interface{})))
-			for _, r := range entity["rules"].([]interface{}) {
-				rule := r.(map[string]interface{})
-				rules = append(rules,
-					Rule{
-					Description: rule["description"].(string),
-					Destination: rule["destination"].(string),
-					Log:         rule["log"].(bool),
-					Ports:       rule["ports"].(string),
-					Protocol:    rule["protocol"].(string),
-				})
-			}
-			securitygroups[metadata["guid"].(string)] =
-				SecurityGroup{
-					Name:           entity["name"].(string),
-					Rules:          rules,
-					RunningDefault: entity["running_default"].(bool),
-					StagingDefault: entity["staging_default"].(bool),
-				}
+		for _, s := range quotasJSON["resources"].([]interface{}) {
+			theQuota := s.(map[string]interface{})
+			metadata := theQuota["metadata"].(map[string]interface{})
+			entity := theQuota["entity"].(map[string]interface{})
+			quotas[metadata["guid"].(string)] = spaceQuotaEntityToSpaceQuota(entity)
 		}
-		if next, ok := securitygroupsJSON["next_url"].(string); ok {
+		if next, ok := quotasJSON["next_url"].(string); ok {
 			nextURL = next
 		} else {
 			nextURL = ""
 		}
 	}
-	return securitygroups, nil
+	return quotas, nil
 }
 
+func spaceQuotaEntityToSpaceQuota(entity map[string]interface{}) SpaceQuota {
+	return SpaceQuota{
+		Name:       				entity["name"].(string),
+		NonBasicServicesAllowed:	entity["non_basic_services_allowed"].(bool),
+		TotalServices:				entity["total_services"].(float64),
+		TotalRoutes:				entity["total_routes"].(float64),
+		MemoryLimit:				entity["memory_limit"].(float64),
+		InstanceMemoryLimit:		entity["instance_memory_limit"].(float64),
+		AppInstanceLimit:			entity["app_instance_limit"].(float64),
+		AppTaskLimit:				entity["app_task_limit"].(float64),
+		TotalServiceKeys:			entity["total_service_keys"].(float64),
+		TotalReservedRoutePorts:	entity["total_reserved_route_ports"].(float64),
+	}
+}
 
-//getServicePlanGuid returns a managed service plan guid
-func (api *APIHelper) getServicePlanGuid(label string, plan string) (string, error) {
-	var guid string
-	query := fmt.Sprintf("label:%s", label)
-	path := fmt.Sprintf("/v2/services?q=%s", url.QueryEscape(query))
-	serviceJSON, err := cfcurl.Curl(api.cli, path)
-	check(err)
-	results := int(serviceJSON["total_results"].(float64))
-	if results == 0 {
-		return "", ErrManagedServiceNotFound
+//GetOrgRoles returns the role assignments of an org
+func (api *APIHelper) GetOrgRoles(orgguid string) (Roles, error) {
+	return getRoles(api, "/v3/roles?include=user&organization_guids="+orgguid)
+}
+
+//GetSpaceRoles returns the role assignments of a space
+func (api *APIHelper) GetSpaceRoles(spaceguid string) (Roles, error) {
+	return getRoles(api, "/v3/roles?include=user&space_guids="+spaceguid)
+}
+
+func getRoles(api *APIHelper, rolesURL string) (Roles, error) {
+	nextURL := rolesURL
+	roles := []Role{}
+	for nextURL != "" {
+		rolesJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		users := make(map[string]map[string]interface{})
+		if included, ok := rolesJSON["included"].(map[string]interface{}); ok {
+			if includedUsers, ok := included["users"].([]interface{}); ok {
+				for _, u := range includedUsers {
+					theUser := u.(map[string]interface{})
+					users[theUser["guid"].(string)] = theUser
+				}
+			}
+		}
+		for _, r := range rolesJSON["resources"].([]interface{}) {
+			theRole := r.(map[string]interface{})
+			relationships := theRole["relationships"].(map[string]interface{})
+			userData := relationships["user"].(map[string]interface{})["data"].(map[string]interface{})
+			theUser, found := users[userData["guid"].(string)]
+			if !found {
+				continue
+			}
+			// client credentials have no username and cannot be reassigned by name
+			username, ok := theUser["username"].(string)
+			if !ok || username == "" {
+				continue
+			}
+			origin, _ := theUser["origin"].(string)
+			roles = append(roles,
+				Role{
+					Type:     theRole["type"].(string),
+					Username: username,
+					Origin:   origin,
+				})
+		}
+		nextURL = nextV3URL(rolesJSON)
 	}
-	resource := serviceJSON["resources"].([]interface{})[0]
-	service := resource.(map[string]interface{})
-	entity := service["entity"].(map[string]interface{})
-	spurl := entity["service_plans_url"].(string)
-	serviceplanJSON, err := cfcurl.Curl(api.cli, spurl)
-	check(err)
-	results = int(serviceplanJSON["total_results"].(float64))
-	if results == 0 {
-		return "", ErrManagedServicePlanNotFound
+	return roles, nil
+}
+
+//getMetadata returns the labels and annotations of a v3 resource
+func getMetadata(api *APIHelper, resourceURL string) Metadata {
+	resourceJSON, err := cfcurl.Curl(api.cli, resourceURL)
+	if nil != err {
+		log.Println("Unable to fetch metadata of " + resourceURL)
+		log.Println(err)
+		return metadataFromResource(nil)
 	}
-	for _, sp := range serviceplanJSON["resources"].([]interface{}) {
-		splan := sp.(map[string]interface{})
-		entity := splan["entity"].(map[string]interface{})
-		name := entity["name"].(string)
-		if name != plan {
-			continue
+	return metadataFromResource(resourceJSON)
+}
+
+//metadataFromResource reads the labels and annotations of a v3 resource
+func metadataFromResource(resource map[string]interface{}) Metadata {
+	metadata := Metadata{
+		Labels:      map[string]string{},
+		Annotations: map[string]string{},
+	}
+	rawMetadata, ok := resource["metadata"].(map[string]interface{})
+	if !ok {
+		return metadata
+	}
+	if labels, ok := rawMetadata["labels"].(map[string]interface{}); ok {
+		for key, value := range labels {
+			if v, ok := value.(string); ok {
+				metadata.Labels[key] = v
+			}
 		}
-		metadata := splan["metadata"].(map[string]interface{})
-		guid = metadata["guid"].(string)
 	}
-	return guid, nil
+	if annotations, ok := rawMetadata["annotations"].(map[string]interface{}); ok {
+		for key, value := range annotations {
+			if v, ok := value.(string); ok {
+				metadata.Annotations[key] = v
+			}
+		}
+	}
+	return metadata
 }
 
-//GetQuotaMemoryLimit retruns the amount of memory (in MB) that the org is allowed
-func (api *APIHelper) GetQuotaMemoryLimit(quotaURL string) (float64, error) {
-	quotaJSON, err := cfcurl.Curl(api.cli, quotaURL)
+//nextV3URL returns the path of the next page of a v3 list response, or "" on the last page
+func nextV3URL(listJSON map[string]interface{}) string {
+	pagination, ok := listJSON["pagination"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	next, ok := pagination["next"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	href, ok := next["href"].(string)
+	if !ok {
+		return ""
+	}
+	u, err := url.Parse(href)
 	if nil != err {
-		return 0, err
+		return ""
 	}
-	return quotaJSON["entity"].(map[string]interface{})["memory_limit"].(float64), nil
+	return u.RequestURI()
 }
 
-//GetOrgSpaces returns the spaces in an org.
-func (api *APIHelper) GetOrgSpaces(spacesURL string) (Spaces, error) {
-	nextURL := spacesURL
-	spaces := []Space{}
+//GetOrgPlanVisibilities returns the service plans made visible to an org by service label and plan name
+func (api *APIHelper) GetOrgPlanVisibilities(orgguid string) (PlanVisibilities, error) {
+	query := fmt.Sprintf("organization_guid:%s", orgguid)
+	nextURL := fmt.Sprintf("/v2/service_plan_visibilities?q=%s", url.QueryEscape(query))
+	visibilities := []PlanVisibility{}
+	labels := make(map[string]string)
 	for nextURL != "" {
-		spacesJSON, err := cfcurl.Curl(api.cli, nextURL)
+		visibilitiesJSON, err := cfcurl.Curl(api.cli, nextURL)
 		if nil != err {
 			return nil, err
 		}
-		for _, s := range spacesJSON["resources"].([]interface{}) {
-			theSpace := s.(map[string]interface{})
-			metadata := theSpace["metadata"].(map[string]interface{})
-			entity := theSpace["entity"].(map[string]interface{})
-			spaces = append(spaces,
-				Space{
-					Guid:		metadata["guid"].(string),
-					Name:       entity["name"].(string),
-					SummaryURL: metadata["url"].(string) + "/summary",
-					SecurityGroupURL: metadata["url"].(string) + "/security_groups",
-					StagingSecurityGroupURL: metadata["url"].(string) + "/staging_security_groups",
-				})
+		resources, ok := visibilitiesJSON["resources"].([]interface{})
+		if !ok {
+			return visibilities, nil
 		}
-		if next, ok := spacesJSON["next_url"].(string); ok {
+		for _, v := range resources {
+			entity := v.(map[string]interface{})["entity"].(map[string]interface{})
+			planJSON, err := cfcurl.Curl(api.cli, "/v2/service_plans/"+entity["service_plan_guid"].(string))
+			if nil != err {
+				return nil, err
+			}
+			planEntity := planJSON["entity"].(map[string]interface{})
+			serviceGuid := planEntity["service_guid"].(string)
+			if _, found := labels[serviceGuid]; !found {
+				serviceJSON, err := cfcurl.Curl(api.cli, "/v2/services/"+serviceGuid)
+				if nil != err {
+					return nil, err
+				}
+				labels[serviceGuid] = serviceJSON["entity"].(map[string]interface{})["label"].(string)
+			}
+			visibilities = append(visibilities, PlanVisibility{
+				Service: labels[serviceGuid],
+				Plan:    planEntity["name"].(string),
+			})
+		}
+		if next, ok := visibilitiesJSON["next_url"].(string); ok {
 			nextURL = next
 		} else {
 			nextURL = ""
 		}
 	}
-	return spaces, nil
-}
-
-//GetSpaceAppsAndServices returns the apps and the services in a space
-func (api *APIHelper) GetSpaceAppsAndServices(space Space) (Apps, Services, SecurityGroups, SecurityGroups, error) {
-	apps := []App{}
-	services := []Service{}
-	securityGroups := []SecurityGroup{}
-	stagingSecurityGroup := []SecurityGroup{}
-	summaryJSON, err := cfcurl.Curl(api.cli, space.SummaryURL)
-	if nil != err {
-		return nil, nil, nil, nil, err
-	}
-	apps,_ = GetApps(api,space.Guid, summaryJSON)
-	services,_ = GetServices(api,summaryJSON)
-	securityGroups,_ = GetSecurityGroups(api,space.SecurityGroupURL)
-	stagingSecurityGroup,_ = GetSecurityGroups(api,space.StagingSecurityGroupURL)
-
-	return apps, services, securityGroups, stagingSecurityGroup, nil
+	return visibilities, nil
 }
 
-func GetApps(api *APIHelper, spaceGuid string, summaryJSON map[string]interface{}) (Apps, error) {
-	// workaround to get real app guids
-	nextURL := "/v3/apps?space_guids=" + spaceGuid
-	appsList := make(map[string]string)
+//GetSpaceServiceBrokers returns the brokers registered in a space
+func (api *APIHelper) GetSpaceServiceBrokers(spaceguid string) (ServiceBrokers, error) {
+	query := fmt.Sprintf("space_guid:%s", spaceguid)
+	nextURL := fmt.Sprintf("/v2/service_brokers?q=%s", url.QueryEscape(query))
+	brokers := []ServiceBroker{}
 	for nextURL != "" {
-		appsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		brokersJSON, err := cfcurl.Curl(api.cli, nextURL)
 		if nil != err {
 			return nil, err
 		}
-		for _, a := range appsJSON["resources"].([]interface{}) {
-			theApp := a.(map[string]interface{})
-			name := theApp["name"].(string)
-			guid := theApp["guid"].(string)
-			appsList[name] = guid
+		resources, ok := brokersJSON["resources"].([]interface{})
+		if !ok {
+			return brokers, nil
 		}
-		pagination := appsJSON["pagination"].(map[string]interface{})
-		if next, ok := pagination["next"].(string); ok {
+		for _, b := range resources {
+			entity := b.(map[string]interface{})["entity"].(map[string]interface{})
+			username, _ := entity["auth_username"].(string)
+			brokers = append(brokers, ServiceBroker{
+				Name:     entity["name"].(string),
+				URL:      entity["broker_url"].(string),
+				Username: username,
+			})
+		}
+		if next, ok := brokersJSON["next_url"].(string); ok {
 			nextURL = next
 		} else {
 			nextURL = ""
 		}
 	}
+	return brokers, nil
+}
 
-
-	apps := []App{}
-	if _, ok := summaryJSON["apps"]; ok {
-		for _, a := range summaryJSON["apps"].([]interface{}) {
-			theApp := a.(map[string]interface{})
-			httpEndpoint, err := theApp["health_check_http_endpoint"].(string)
-			if err {
-				httpEndpoint = ""
-			}
-			httpTimeout, err := theApp["health_check_timeout"].(float64)
-			if err {
-				httpTimeout = 180
+//GetOrgIsolationSegments returns the names of the isolation segments an org is entitled to and its default segment
+func (api *APIHelper) GetOrgIsolationSegments(orgguid string) ([]string, string, error) {
+	nextURL := "/v3/isolation_segments?organization_guids=" + orgguid
+	segments := []string{}
+	for nextURL != "" {
+		segmentsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, "", err
+		}
+		if resources, ok := segmentsJSON["resources"].([]interface{}); ok {
+			for _, r := range resources {
+				segments = append(segments, r.(map[string]interface{})["name"].(string))
 			}
-			environmentVar, ok := theApp["environment_json"].(map[string]interface{})
-			if ok {
-				if _, ok := environmentVar["redacted_message"]; ok {
-					environmentVar = make(map[string]interface{})
-				}
+		}
+		nextURL = nextV3URL(segmentsJSON)
+	}
+	defaultSegment, err := getIsolationSegmentRelationship(api, "/v3/organizations/"+orgguid+"/relationships/default_isolation_segment")
+	if nil != err {
+		return nil, "", err
+	}
+	return segments, defaultSegment, nil
+}
+
+//GetSpaceIsolationSegment returns the name of the isolation segment a space is assigned to, or ""
+func (api *APIHelper) GetSpaceIsolationSegment(spaceguid string) (string, error) {
+	return getIsolationSegmentRelationship(api, "/v3/spaces/"+spaceguid+"/relationships/isolation_segment")
+}
+
+//getIsolationSegmentRelationship resolves the name of the isolation segment of an org or space relationship
+func getIsolationSegmentRelationship(api *APIHelper, relationshipURL string) (string, error) {
+	relationshipJSON, err := cfcurl.Curl(api.cli, relationshipURL)
+	if nil != err {
+		return "", err
+	}
+	data, ok := relationshipJSON["data"].(map[string]interface{})
+	if !ok {
+		return "", nil
+	}
+	segmentJSON, err := cfcurl.Curl(api.cli, "/v3/isolation_segments/"+data["guid"].(string))
+	if nil != err {
+		return "", err
+	}
+	name, _ := segmentJSON["name"].(string)
+	return name, nil
+}
+
+//GetIsolationSegmentGuid returns the guid of an isolation segment
+func (api *APIHelper) GetIsolationSegmentGuid(name string) (string, error) {
+	segmentsJSON, err := cfcurl.Curl(api.cli, "/v3/isolation_segments?names="+url.QueryEscape(name))
+	if nil != err {
+		return "", err
+	}
+	resources, ok := segmentsJSON["resources"].([]interface{})
+	if !ok || len(resources) == 0 {
+		return "", ErrIsolationSegmentNotFound
+	}
+	return resources[0].(map[string]interface{})["guid"].(string), nil
+}
+
+//GetOrgPrivateDomains returns the private domains owned by or shared with an org
+func (api *APIHelper) GetOrgPrivateDomains(orgguid string) (PrivateDomains, error) {
+	nextURL := "/v2/organizations/" + orgguid + "/private_domains"
+	domains := []PrivateDomain{}
+	orgNames := make(map[string]string)
+	for nextURL != "" {
+		domainsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		for _, d := range domainsJSON["resources"].([]interface{}) {
+			theDomain := d.(map[string]interface{})
+			entity := theDomain["entity"].(map[string]interface{})
+			ownerGuid, _ := entity["owning_organization_guid"].(string)
+			ownerName, found := orgNames[ownerGuid]
+			if !found {
+				orgJSON, err := cfcurl.Curl(api.cli, "/v2/organizations/"+ownerGuid)
+				if nil != err {
+					return nil, err
+				}
+				if orgEntity, ok := orgJSON["entity"].(map[string]interface{}); ok {
+					ownerName = orgEntity["name"].(string)
+				}
+				orgNames[ownerGuid] = ownerName
+			}
+			domains = append(domains,
+				PrivateDomain{
+					Name:               entity["name"].(string),
+					OwningOrganization: ownerName,
+				})
+		}
+		if next, ok := domainsJSON["next_url"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
+		}
+	}
+	return domains, nil
+}
+
+//GetNetworkPolicies returns the container-to-container network policies visible to the user
+func (api *APIHelper) GetNetworkPolicies() (NetworkPolicies, error) {
+	policiesJSON, err := cfcurl.Curl(api.cli, "/networking/v1/external/policies")
+	if nil != err {
+		return nil, err
+	}
+	policies := []NetworkPolicy{}
+	rawPolicies, ok := policiesJSON["policies"].([]interface{})
+	if !ok {
+		return policies, nil
+	}
+	for _, p := range rawPolicies {
+		thePolicy := p.(map[string]interface{})
+		source := thePolicy["source"].(map[string]interface{})
+		destination := thePolicy["destination"].(map[string]interface{})
+		ports := destination["ports"].(map[string]interface{})
+		policies = append(policies,
+			NetworkPolicy{
+				SourceGuid:      source["id"].(string),
+				DestinationGuid: destination["id"].(string),
+				Protocol:        destination["protocol"].(string),
+				StartPort:       ports["start"].(float64),
+				EndPort:         ports["end"].(float64),
+			})
+	}
+	return policies, nil
+}
+
+//IsSSHEnabled reports whether the foundation exposes an SSH endpoint for apps
+func (api *APIHelper) IsSSHEnabled() bool {
+	infoJSON, err := cfcurl.Curl(api.cli, "/v2/info")
+	if nil != err {
+		return false
+	}
+	endpoint, _ := infoJSON["app_ssh_endpoint"].(string)
+	return endpoint != ""
+}
+
+//IsAdmin reports whether the current access token carries the cloud_controller.admin scope
+func (api *APIHelper) IsAdmin() bool {
+	accessToken, err := api.cli.AccessToken()
+	if nil != err {
+		return false
+	}
+	parts := strings.Split(accessToken, ".")
+	if len(parts) < 2 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if nil != err {
+		return false
+	}
+	var claims struct {
+		Scope []string `json:"scope"`
+	}
+	if nil != json.Unmarshal(payload, &claims) {
+		return false
+	}
+	for _, scope := range claims.Scope {
+		if scope == "cloud_controller.admin" {
+			return true
+		}
+	}
+	return false
+}
+
+//GetPlatformConfig returns the feature flags and the running and staging environment variable groups
+func (api *APIHelper) GetPlatformConfig() (PlatformConfig, error) {
+	config := PlatformConfig{
+		FeatureFlags: map[string]bool{},
+	}
+	nextURL := "/v3/feature_flags"
+	for nextURL != "" {
+		flagsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return PlatformConfig{}, err
+		}
+		if resources, ok := flagsJSON["resources"].([]interface{}); ok {
+			for _, f := range resources {
+				theFlag := f.(map[string]interface{})
+				config.FeatureFlags[theFlag["name"].(string)] = theFlag["enabled"].(bool)
+			}
+		}
+		nextURL = nextV3URL(flagsJSON)
+	}
+	var err error
+	config.RunningEnvironmentVariables, err = getEnvironmentVariableGroup(api, "running")
+	if nil != err {
+		return PlatformConfig{}, err
+	}
+	config.StagingEnvironmentVariables, err = getEnvironmentVariableGroup(api, "staging")
+	if nil != err {
+		return PlatformConfig{}, err
+	}
+	return config, nil
+}
+
+//GetBuildpacks returns the admin buildpacks ordered by position
+func (api *APIHelper) GetBuildpacks() (Buildpacks, error) {
+	nextURL := "/v3/buildpacks?order_by=position"
+	buildpacks := []Buildpack{}
+	for nextURL != "" {
+		buildpacksJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		if resources, ok := buildpacksJSON["resources"].([]interface{}); ok {
+			for _, b := range resources {
+				theBuildpack := b.(map[string]interface{})
+				buildpack := Buildpack{
+					Guid:     theBuildpack["guid"].(string),
+					Name:     theBuildpack["name"].(string),
+					Position: theBuildpack["position"].(float64),
+					Enabled:  theBuildpack["enabled"].(bool),
+					Locked:   theBuildpack["locked"].(bool),
+				}
+				buildpack.Stack, _ = theBuildpack["stack"].(string)
+				buildpack.Filename, _ = theBuildpack["filename"].(string)
+				buildpacks = append(buildpacks, buildpack)
+			}
+		}
+		nextURL = nextV3URL(buildpacksJSON)
+	}
+	return buildpacks, nil
+}
+
+func getEnvironmentVariableGroup(api *APIHelper, group string) (map[string]interface{}, error) {
+	groupJSON, err := cfcurl.Curl(api.cli, "/v3/environment_variable_groups/"+group)
+	if nil != err {
+		return nil, err
+	}
+	vars, ok := groupJSON["var"].(map[string]interface{})
+	if !ok {
+		vars = map[string]interface{}{}
+	}
+	return vars, nil
+}
+
+//GetSecurityGroups returns SecurityGroups
+func (api *APIHelper) GetSecurityGroups() (map[string]SecurityGroup, error) {
+	nextURL := "/v2/security_groups"
+	securitygroups := make(map[string]SecurityGroup)
+	for nextURL != "" {
+		securitygroupsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		resources, ok := securitygroupsJSON["resources"].([]interface{})
+		if !ok {
+			return securitygroups, nil
+		}
+		for _, s := range resources {
+			metadata := s.(map[string]interface{})["metadata"].(map[string]interface{})
+			securitygroups[metadata["guid"].(string)] = securityGroupResourceToSecurityGroup(s)
+		}
+		if next, ok := securitygroupsJSON["next_url"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
+		}
+	}
+	return securitygroups, nil
+}
+
+
+//getServicePlanGuid returns a managed service plan guid
+func (api *APIHelper) getServicePlanGuid(label string, plan string) (string, error) {
+	var guid string
+	query := fmt.Sprintf("label:%s", label)
+	path := fmt.Sprintf("/v2/services?q=%s", url.QueryEscape(query))
+	serviceJSON, err := cfcurl.Curl(api.cli, path)
+	check(err)
+	results := int(serviceJSON["total_results"].(float64))
+	if results == 0 {
+		return "", ErrManagedServiceNotFound
+	}
+	resource := serviceJSON["resources"].([]interface{})[0]
+	service := resource.(map[string]interface{})
+	entity := service["entity"].(map[string]interface{})
+	spurl := entity["service_plans_url"].(string)
+	serviceplanJSON, err := cfcurl.Curl(api.cli, spurl)
+	check(err)
+	results = int(serviceplanJSON["total_results"].(float64))
+	if results == 0 {
+		return "", ErrManagedServicePlanNotFound
+	}
+	for _, sp := range serviceplanJSON["resources"].([]interface{}) {
+		splan := sp.(map[string]interface{})
+		entity := splan["entity"].(map[string]interface{})
+		name := entity["name"].(string)
+		if name != plan {
+			continue
+		}
+		metadata := splan["metadata"].(map[string]interface{})
+		guid = metadata["guid"].(string)
+	}
+	return guid, nil
+}
+
+//GetQuotaMemoryLimit retruns the amount of memory (in MB) that the org is allowed
+func (api *APIHelper) GetQuotaMemoryLimit(quotaURL string) (float64, error) {
+	quotaJSON, err := cfcurl.Curl(api.cli, quotaURL)
+	if nil != err {
+		return 0, err
+	}
+	return quotaJSON["entity"].(map[string]interface{})["memory_limit"].(float64), nil
+}
+
+//GetOrgSpaces returns the spaces in an org.
+func (api *APIHelper) GetOrgSpaces(spacesURL string) (Spaces, error) {
+	nextURL := spacesURL
+	spaces := []Space{}
+	for nextURL != "" {
+		spacesJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		for _, s := range spacesJSON["resources"].([]interface{}) {
+			theSpace := s.(map[string]interface{})
+			metadata := theSpace["metadata"].(map[string]interface{})
+			entity := theSpace["entity"].(map[string]interface{})
+			spaceQuotaGUID, _ := entity["space_quota_definition_guid"].(string)
+			spaceGuid := metadata["guid"].(string)
+			allowSsh, _ := entity["allow_ssh"].(bool)
+			spaces = append(spaces,
+				Space{
+					Guid:		spaceGuid,
+					Name:       entity["name"].(string),
+					SummaryURL: metadata["url"].(string) + "/summary",
+					SecurityGroupURL: metadata["url"].(string) + "/security_groups",
+					StagingSecurityGroupURL: metadata["url"].(string) + "/staging_security_groups",
+					SpaceQuotaGUID: spaceQuotaGUID,
+					AllowSsh: allowSsh,
+					Metadata: getMetadata(api, "/v3/spaces/"+spaceGuid),
+				})
+		}
+		if next, ok := spacesJSON["next_url"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
+		}
+	}
+	return spaces, nil
+}
+
+//GetSpaceAppsAndServices returns the apps and the services in a space
+func (api *APIHelper) GetSpaceAppsAndServices(space Space) (Apps, Services, SecurityGroups, SecurityGroups, error) {
+	apps := []App{}
+	services := []Service{}
+	securityGroups := []SecurityGroup{}
+	stagingSecurityGroup := []SecurityGroup{}
+	summaryJSON, err := cfcurl.Curl(api.cli, space.SummaryURL)
+	if nil != err {
+		return nil, nil, nil, nil, err
+	}
+	apps, err = GetApps(api, space.Guid, summaryJSON)
+	if nil != err {
+		log.Println("Error: unable to export apps of space " + space.Name)
+		return nil, nil, nil, nil, err
+	}
+	services, err = GetServices(api, summaryJSON)
+	if nil != err {
+		log.Println("Error: unable to export service instances of space " + space.Name)
+		return nil, nil, nil, nil, err
+	}
+	securityGroups,_ = GetSecurityGroups(api,space.SecurityGroupURL)
+	stagingSecurityGroup,_ = GetSecurityGroups(api,space.StagingSecurityGroupURL)
+
+	return apps, services, securityGroups, stagingSecurityGroup, nil
+}
+
+func GetApps(api *APIHelper, spaceGuid string, summaryJSON map[string]interface{}) (Apps, error) {
+	// workaround to get real app guids
+	nextURL := "/v3/apps?space_guids=" + spaceGuid
+	appsList := make(map[string]string)
+	lifecycles := make(map[string]map[string]interface{})
+	metadatas := make(map[string]Metadata)
+	for nextURL != "" {
+		appsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		for _, a := range appsJSON["resources"].([]interface{}) {
+			theApp := a.(map[string]interface{})
+			name := theApp["name"].(string)
+			guid := theApp["guid"].(string)
+			appsList[name] = guid
+			metadatas[name] = metadataFromResource(theApp)
+			if lifecycle, ok := theApp["lifecycle"].(map[string]interface{}); ok {
+				lifecycles[name] = lifecycle
+			}
+		}
+		pagination := appsJSON["pagination"].(map[string]interface{})
+		if next, ok := pagination["next"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
+		}
+	}
+
+
+	instanceNames := make(map[string]string)
+	if services, ok := summaryJSON["services"].([]interface{}); ok {
+		for _, s := range services {
+			theService := s.(map[string]interface{})
+			instanceNames[theService["guid"].(string)] = theService["name"].(string)
+		}
+	}
+	apps := []App{}
+	if _, ok := summaryJSON["apps"]; ok {
+		for _, a := range summaryJSON["apps"].([]interface{}) {
+			theApp := a.(map[string]interface{})
+			httpEndpoint, err := theApp["health_check_http_endpoint"].(string)
+			if err {
+				httpEndpoint = ""
+			}
+			httpTimeout, err := theApp["health_check_timeout"].(float64)
+			if err {
+				httpTimeout = 180
+			}
+			environmentVar, ok := theApp["environment_json"].(map[string]interface{})
+			if ok {
+				if _, ok := environmentVar["redacted_message"]; ok {
+					environmentVar = make(map[string]interface{})
+				}
 			}
 			name := theApp["name"].(string)
 			appGuid := theApp["guid"].(string)
@@ -539,6 +1296,53 @@ func GetApps(api *APIHelper, spaceGuid string, summaryJSON map[string]interface{
 				}
 				appGuid = guid
 			}
+			ports := []float64{}
+			if rawPorts, ok := theApp["ports"].([]interface{}); ok {
+				for _, p := range rawPorts {
+					ports = append(ports, p.(float64))
+				}
+			}
+			routes, routesErr := getAppRoutes(api, appGuid)
+			if nil != routesErr {
+				log.Println("Error reading routes of app " + name)
+				return nil, routesErr
+			}
+			buildpacks := []string{}
+			stack := ""
+			if lifecycle, ok := lifecycles[name]; ok {
+				if data, ok := lifecycle["data"].(map[string]interface{}); ok {
+					if rawBuildpacks, ok := data["buildpacks"].([]interface{}); ok {
+						for _, b := range rawBuildpacks {
+							buildpacks = append(buildpacks, b.(string))
+						}
+					}
+					stack, _ = data["stack"].(string)
+				}
+			}
+			detectedBuildpack, buildpackVersion, dropletStack := getDropletBuildpack(api, appGuid)
+			if stack == "" {
+				stack = dropletStack
+			}
+			processes, processesErr := getAppProcesses(api, appGuid)
+			if nil != processesErr {
+				log.Println("Error reading processes of app " + name)
+				return nil, processesErr
+			}
+			sidecars, sidecarsErr := getAppSidecars(api, appGuid)
+			if nil != sidecarsErr {
+				log.Println("Error reading sidecars of app " + name)
+				return nil, sidecarsErr
+			}
+			bindings, bindingsErr := getAppServiceBindings(api, appGuid, instanceNames)
+			if nil != bindingsErr {
+				log.Println("Error reading service bindings of app " + name)
+				return nil, bindingsErr
+			}
+			dockerImage := ""
+			dockerUsername := ""
+			if lifecycle, ok := lifecycles[name]; ok && lifecycle["type"] == "docker" {
+				dockerImage, dockerUsername = getDockerImage(api, appGuid)
+			}
 			apps = append(apps,
 				App{
 					Guid:                    appGuid,
@@ -556,15 +1360,314 @@ func GetApps(api *APIHelper, spaceGuid string, summaryJSON map[string]interface{
 					EnableSsh:      theApp["enable_ssh"].(bool),
 					EnviornmentVar: environmentVar,
 					ServiceNames:   theApp["service_names"].([]interface{}),
-					URLs:           theApp["urls"].([]interface{}),
+					Ports:          ports,
+					Routes:         routes,
+					Buildpacks:        buildpacks,
+					DetectedBuildpack: detectedBuildpack,
+					BuildpackVersion:  buildpackVersion,
+					Stack:             stack,
+					DockerImage:       dockerImage,
+					DockerUsername:    dockerUsername,
+					Processes:         processes,
+					Sidecars:          sidecars,
+					Metadata:          metadatas[name],
+					ServiceBindings:   bindings,
 				})
 		}
 	}
 	return apps, nil
 }
 
+//getDropletBuildpack returns the detected buildpack, its version and the stack of the app's current droplet
+func getDropletBuildpack(api *APIHelper, appGuid string) (string, string, string) {
+	dropletJSON, err := cfcurl.Curl(api.cli, "/v3/apps/"+appGuid+"/droplets/current")
+	if nil != err {
+		log.Println(err)
+		return "", "", ""
+	}
+	detected := ""
+	version := ""
+	stack, _ := dropletJSON["stack"].(string)
+	if buildpacks, ok := dropletJSON["buildpacks"].([]interface{}); ok && len(buildpacks) > 0 {
+		// the last buildpack is the one that supplied the start command
+		buildpack := buildpacks[len(buildpacks)-1].(map[string]interface{})
+		if name, ok := buildpack["buildpack_name"].(string); ok && name != "" {
+			detected = name
+		} else {
+			detected, _ = buildpack["name"].(string)
+		}
+		version, _ = buildpack["version"].(string)
+	}
+	return detected, version, stack
+}
+
+//getAppProcesses returns every process type of an app with its scale, command and health check
+func getAppProcesses(api *APIHelper, appGuid string) (Processes, error) {
+	nextURL := "/v3/apps/" + appGuid + "/processes"
+	processes := []Process{}
+	for nextURL != "" {
+		processesJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		resources, ok := processesJSON["resources"].([]interface{})
+		if !ok {
+			return processes, nil
+		}
+		for _, p := range resources {
+			theProcess := p.(map[string]interface{})
+			process := Process{
+				Type:      theProcess["type"].(string),
+				Instances: theProcess["instances"].(float64),
+				Memory:    theProcess["memory_in_mb"].(float64),
+				DiskQuota: theProcess["disk_in_mb"].(float64),
+			}
+			process.Command, _ = theProcess["command"].(string)
+			if healthCheck, ok := theProcess["health_check"].(map[string]interface{}); ok {
+				process.HealthCheckType, _ = healthCheck["type"].(string)
+				if data, ok := healthCheck["data"].(map[string]interface{}); ok {
+					process.HealthCheckTimeout, _ = data["timeout"].(float64)
+					process.HealthCheckInvocationTimeout, _ = data["invocation_timeout"].(float64)
+					process.HealthCheckHttpEndpoint, _ = data["endpoint"].(string)
+				}
+			}
+			processes = append(processes, process)
+		}
+		nextURL = nextV3URL(processesJSON)
+	}
+	return processes, nil
+}
+
+//getAppSidecars returns the user defined sidecars of an app, buildpack sidecars come back with the droplet
+func getAppSidecars(api *APIHelper, appGuid string) (Sidecars, error) {
+	nextURL := "/v3/apps/" + appGuid + "/sidecars"
+	sidecars := []Sidecar{}
+	for nextURL != "" {
+		sidecarsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		resources, ok := sidecarsJSON["resources"].([]interface{})
+		if !ok {
+			return sidecars, nil
+		}
+		for _, sc := range resources {
+			theSidecar := sc.(map[string]interface{})
+			if origin, _ := theSidecar["origin"].(string); origin == "buildpack" {
+				continue
+			}
+			sidecar := Sidecar{
+				Name:         theSidecar["name"].(string),
+				Command:      theSidecar["command"].(string),
+				ProcessTypes: []string{},
+			}
+			sidecar.Memory, _ = theSidecar["memory_in_mb"].(float64)
+			if processTypes, ok := theSidecar["process_types"].([]interface{}); ok {
+				for _, t := range processTypes {
+					sidecar.ProcessTypes = append(sidecar.ProcessTypes, t.(string))
+				}
+			}
+			sidecars = append(sidecars, sidecar)
+		}
+		nextURL = nextV3URL(sidecarsJSON)
+	}
+	return sidecars, nil
+}
+
+//getAppServiceBindings returns the name and parameters of the service bindings of an app
+func getAppServiceBindings(api *APIHelper, appGuid string, instanceNames map[string]string) (ServiceBindings, error) {
+	nextURL := "/v2/apps/" + appGuid + "/service_bindings"
+	bindings := []ServiceBinding{}
+	for nextURL != "" {
+		bindingsJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		resources, ok := bindingsJSON["resources"].([]interface{})
+		if !ok {
+			return bindings, nil
+		}
+		for _, b := range resources {
+			theBinding := b.(map[string]interface{})
+			metadata := theBinding["metadata"].(map[string]interface{})
+			entity := theBinding["entity"].(map[string]interface{})
+			binding := ServiceBinding{
+				InstanceName: instanceNames[entity["service_instance_guid"].(string)],
+			}
+			binding.Name, _ = entity["name"].(string)
+			if mounts, ok := entity["volume_mounts"].([]interface{}); ok {
+				for _, m := range mounts {
+					theMount := m.(map[string]interface{})
+					mount := VolumeMount{}
+					mount.ContainerDir, _ = theMount["container_dir"].(string)
+					mount.Mode, _ = theMount["mode"].(string)
+					mount.DeviceType, _ = theMount["device_type"].(string)
+					binding.VolumeMounts = append(binding.VolumeMounts, mount)
+				}
+			}
+			parametersJSON, err := cfcurl.Curl(api.cli, "/v2/service_bindings/"+metadata["guid"].(string)+"/parameters")
+			if nil == err {
+				if _, ok := parametersJSON["error_code"]; !ok && len(parametersJSON) > 0 {
+					binding.Parameters = parametersJSON
+				}
+			}
+			bindings = append(bindings, binding)
+		}
+		if next, ok := bindingsJSON["next_url"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
+		}
+	}
+	return bindings, nil
+}
+
+//getDockerImage returns the image reference and registry username of a Docker app, the password is never returned by the API
+func getDockerImage(api *APIHelper, appGuid string) (string, string) {
+	appJSON, err := cfcurl.Curl(api.cli, "/v2/apps/"+appGuid)
+	if nil != err {
+		log.Println(err)
+		return "", ""
+	}
+	entity, ok := appJSON["entity"].(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	image, _ := entity["docker_image"].(string)
+	username := ""
+	if credentials, ok := entity["docker_credentials"].(map[string]interface{}); ok {
+		username, _ = credentials["username"].(string)
+	}
+	return image, username
+}
+
+//getAppRoutes returns the routes mapped to an app together with the app port each route is mapped to
+func getAppRoutes(api *APIHelper, appGuid string) (Routes, error) {
+	nextURL := "/v3/routes?include=domain&app_guids=" + appGuid
+	routes := []Route{}
+	for nextURL != "" {
+		routesJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		domains := make(map[string]map[string]interface{})
+		if included, ok := routesJSON["included"].(map[string]interface{}); ok {
+			if includedDomains, ok := included["domains"].([]interface{}); ok {
+				for _, d := range includedDomains {
+					theDomain := d.(map[string]interface{})
+					domains[theDomain["guid"].(string)] = theDomain
+				}
+			}
+		}
+		for _, r := range routesJSON["resources"].([]interface{}) {
+			theRoute := r.(map[string]interface{})
+			relationships := theRoute["relationships"].(map[string]interface{})
+			domainData := relationships["domain"].(map[string]interface{})["data"].(map[string]interface{})
+			route := Route{}
+			route.Host, _ = theRoute["host"].(string)
+			route.Path, _ = theRoute["path"].(string)
+			route.Port, _ = theRoute["port"].(float64)
+			if theDomain, found := domains[domainData["guid"].(string)]; found {
+				route.Domain = theDomain["name"].(string)
+				if routerGroup, ok := theDomain["router_group"].(map[string]interface{}); ok {
+					route.RouterGroup = api.routerGroupName(routerGroup["guid"].(string))
+				}
+			}
+			if destinations, ok := theRoute["destinations"].([]interface{}); ok {
+				for _, d := range destinations {
+					destination := d.(map[string]interface{})
+					app := destination["app"].(map[string]interface{})
+					if app["guid"].(string) != appGuid {
+						continue
+					}
+					route.AppPort, _ = destination["port"].(float64)
+					routes = append(routes, route)
+				}
+			}
+		}
+		nextURL = nextV3URL(routesJSON)
+	}
+	return routes, nil
+}
+
+//routerGroupName returns the name of a router group, loading them from the routing API on first use
+func (api *APIHelper) routerGroupName(guid string) string {
+	if nil == api.routerGroups {
+		api.routerGroups = getRouterGroups(api)
+	}
+	return api.routerGroups[guid]
+}
+
+//routerGroupGuid returns the guid of a router group by name
+func (api *APIHelper) routerGroupGuid(name string) string {
+	if nil == api.routerGroups {
+		api.routerGroups = getRouterGroups(api)
+	}
+	for guid, n := range api.routerGroups {
+		if n == name {
+			return guid
+		}
+	}
+	return ""
+}
+
+//getRouterGroups returns router group names by guid, router groups are only served by the routing API
+func getRouterGroups(api *APIHelper) map[string]string {
+	routerGroups := make(map[string]string)
+	infoJSON, err := cfcurl.Curl(api.cli, "/v2/info")
+	if nil != err {
+		log.Println(err)
+		return routerGroups
+	}
+	routingEndpoint, ok := infoJSON["routing_endpoint"].(string)
+	if !ok || routingEndpoint == "" {
+		return routerGroups
+	}
+	accessToken, err := api.cli.AccessToken()
+	if nil != err {
+		log.Println(err)
+		return routerGroups
+	}
+	req, _ := http.NewRequest("GET", routingEndpoint+"/v1/router_groups", nil)
+	req.Header.Set("Authorization", accessToken)
+	res, err := client.Do(req)
+	if err != nil {
+		log.Println(err)
+		log.Println("HTTP_URL: " + routingEndpoint + "/v1/router_groups")
+		return routerGroups
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if nil != err {
+		log.Println(err)
+		return routerGroups
+	}
+	var groups []map[string]interface{}
+	if err := json.Unmarshal(body, &groups); nil != err {
+		log.Println("Error reading router groups: " + string(body))
+		return routerGroups
+	}
+	for _, g := range groups {
+		routerGroups[g["guid"].(string)] = g["name"].(string)
+	}
+	return routerGroups
+}
+
+//routeURL returns the route in the host.domain[:port][/path] form used in logs
+func routeURL(route Route) string {
+	u := route.Domain
+	if route.Host != "" {
+		u = route.Host + "." + u
+	}
+	if route.Port > 0 {
+		u = u + ":" + strconv.Itoa(int(route.Port))
+	}
+	return u + route.Path
+}
+
 func GetServices(api *APIHelper, summaryJSON map[string]interface{}) (Services, error) {
 	services := []Service{}
+	spaceGuid, _ := summaryJSON["guid"].(string)
 	if _, ok := summaryJSON["services"]; ok {
 		for _, s := range summaryJSON["services"].([]interface{}) {
 			theService := s.(map[string]interface{})
@@ -575,12 +1678,52 @@ func GetServices(api *APIHelper, summaryJSON map[string]interface{}) (Services,
 				if _, serviceExist := servicePlan["service"]; serviceExist {
 					service := servicePlan["service"].(map[string]interface{})
 					label := service["label"].(string)
+					guid := theService["guid"].(string)
+					routes, err := getServiceInstanceRoutes(api, "/v2/service_instances/"+guid+"/routes")
+					if nil != err {
+						return nil, err
+					}
+					tags := []string{}
+					sharedFrom := SpaceRef{}
+					sharedTo := []SpaceRef{}
+					instanceJSON, err := cfcurl.Curl(api.cli, "/v2/service_instances/"+guid)
+					if nil != err {
+						return nil, err
+					}
+					if entity, ok := instanceJSON["entity"].(map[string]interface{}); ok {
+						if rawTags, ok := entity["tags"].([]interface{}); ok {
+							for _, t := range rawTags {
+								tags = append(tags, t.(string))
+							}
+						}
+						// instances shared into the space are owned by another space
+						if owner, _ := entity["space_guid"].(string); owner != "" && spaceGuid != "" && owner != spaceGuid {
+							sharedFrom, err = getSharedFrom(api, guid)
+						} else {
+							sharedTo, err = getSharedTo(api, guid)
+						}
+						if nil != err {
+							return nil, err
+						}
+					}
+					serviceKeys, err := getServiceKeys(api, guid)
+					if nil != err {
+						return nil, err
+					}
 					services = append(services,
 						Service{
+							Guid:         guid,
 							InstanceName: name,
 							Label:        label,
 							ServicePlan:  servicePlan["name"].(string),
 							Type:         "managed",
+							Routes:       routes,
+							Tags:         tags,
+							Parameters:   getServiceInstanceParameters(api, name, guid),
+							ServiceKeys:  serviceKeys,
+							Metadata:     getMetadata(api, "/v3/service_instances/"+guid),
+							SharedFrom:   sharedFrom,
+							SharedTo:     sharedTo,
 						})
 				}
 				//}
@@ -591,28 +1734,176 @@ func GetServices(api *APIHelper, summaryJSON map[string]interface{}) (Services,
 				if nil != err {
 					return nil, err
 				}
-				if _, ok := cupsJSON["entity"]; ok {
-					entity := cupsJSON["entity"].(map[string]interface{})
-					cred, ok := entity["credentials"].(map[string]interface{})
-					if ok {
-						if _, ok := cred["redacted_message"]; ok {
-							cred = make(map[string]interface{})
-						}
-					}
-					services = append(services,
-						Service{
-							InstanceName: name,
-							Label:        "",
-							ServicePlan:  "",
-							Type:         "user_provided",
-							Credentials:  cred,
-							SyslogDrain:  entity["syslog_drain_url"].(string),
-						})
+				if _, ok := cupsJSON["entity"]; ok {
+					entity := cupsJSON["entity"].(map[string]interface{})
+					cred, ok := entity["credentials"].(map[string]interface{})
+					if ok {
+						if _, ok := cred["redacted_message"]; ok {
+							cred = make(map[string]interface{})
+						}
+					}
+					routeServiceURL, _ := entity["route_service_url"].(string)
+					routes, err := getServiceInstanceRoutes(api, "/v2/user_provided_service_instances/"+guid+"/routes")
+					if nil != err {
+						return nil, err
+					}
+					services = append(services,
+						Service{
+							Guid:            guid,
+							InstanceName:    name,
+							Label:           "",
+							ServicePlan:     "",
+							Type:            "user_provided",
+							Credentials:     cred,
+							SyslogDrain:     entity["syslog_drain_url"].(string),
+							RouteServiceURL: routeServiceURL,
+							Routes:          routes,
+							Metadata:        getMetadata(api, "/v3/service_instances/"+guid),
+						})
+				}
+			}
+		}
+	}
+	return services, nil
+}
+
+//getSharedFrom returns the org and space owning a service instance shared into another space
+func getSharedFrom(api *APIHelper, siguid string) (SpaceRef, error) {
+	sharedFromJSON, err := cfcurl.Curl(api.cli, "/v2/service_instances/"+siguid+"/shared_from")
+	if nil != err {
+		return SpaceRef{}, err
+	}
+	organization, _ := sharedFromJSON["organization_name"].(string)
+	space, _ := sharedFromJSON["space_name"].(string)
+	return SpaceRef{Org: organization, Space: space}, nil
+}
+
+//getSharedTo returns the orgs and spaces a service instance is shared into
+func getSharedTo(api *APIHelper, siguid string) ([]SpaceRef, error) {
+	nextURL := "/v2/service_instances/" + siguid + "/shared_to"
+	spaces := []SpaceRef{}
+	for nextURL != "" {
+		sharedToJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		if resources, ok := sharedToJSON["resources"].([]interface{}); ok {
+			for _, r := range resources {
+				theSpace := r.(map[string]interface{})
+				spaces = append(spaces, SpaceRef{
+					Org:   theSpace["organization_name"].(string),
+					Space: theSpace["space_name"].(string),
+				})
+			}
+		}
+		if next, ok := sharedToJSON["next_url"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
+		}
+	}
+	return spaces, nil
+}
+
+//getServiceInstanceParameters returns the provisioning parameters of a managed service instance,
+//or nil when the broker does not support fetching them
+func getServiceInstanceParameters(api *APIHelper, name string, guid string) map[string]interface{} {
+	parametersJSON, err := cfcurl.Curl(api.cli, "/v2/service_instances/"+guid+"/parameters")
+	if nil != err {
+		log.Println("Unable to fetch parameters of service instance " + name)
+		log.Println(err)
+		return nil
+	}
+	if _, ok := parametersJSON["error_code"]; ok {
+		log.Println("Broker does not return parameters of service instance " + name + ": " + fmt.Sprint(parametersJSON["description"]))
+		return nil
+	}
+	return parametersJSON
+}
+
+//getServiceKeys returns the service keys of a managed service instance with their creation parameters
+func getServiceKeys(api *APIHelper, siguid string) (ServiceKeys, error) {
+	nextURL := "/v2/service_instances/" + siguid + "/service_keys"
+	keys := []ServiceKey{}
+	for nextURL != "" {
+		keysJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		resources, ok := keysJSON["resources"].([]interface{})
+		if !ok {
+			return keys, nil
+		}
+		for _, k := range resources {
+			theKey := k.(map[string]interface{})
+			metadata := theKey["metadata"].(map[string]interface{})
+			entity := theKey["entity"].(map[string]interface{})
+			name := entity["name"].(string)
+			var parameters map[string]interface{}
+			parametersJSON, err := cfcurl.Curl(api.cli, "/v2/service_keys/"+metadata["guid"].(string)+"/parameters")
+			if nil != err {
+				log.Println("Unable to fetch parameters of service key " + name)
+				log.Println(err)
+			} else if _, ok := parametersJSON["error_code"]; !ok {
+				parameters = parametersJSON
+			}
+			keys = append(keys,
+				ServiceKey{
+					Name:       name,
+					Parameters: parameters,
+				})
+		}
+		if next, ok := keysJSON["next_url"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
+		}
+	}
+	return keys, nil
+}
+
+//getServiceInstanceRoutes returns the routes bound to a route service instance
+func getServiceInstanceRoutes(api *APIHelper, routesURL string) (Routes, error) {
+	nextURL := routesURL
+	routes := []Route{}
+	domains := make(map[string]string)
+	for nextURL != "" {
+		routesJSON, err := cfcurl.Curl(api.cli, nextURL)
+		if nil != err {
+			return nil, err
+		}
+		resources, ok := routesJSON["resources"].([]interface{})
+		if !ok {
+			return routes, nil
+		}
+		for _, r := range resources {
+			theRoute := r.(map[string]interface{})
+			entity := theRoute["entity"].(map[string]interface{})
+			domainURL := entity["domain_url"].(string)
+			domainName, found := domains[domainURL]
+			if !found {
+				domainJSON, err := cfcurl.Curl(api.cli, domainURL)
+				if nil != err {
+					return nil, err
+				}
+				if domainEntity, ok := domainJSON["entity"].(map[string]interface{}); ok {
+					domainName = domainEntity["name"].(string)
 				}
+				domains[domainURL] = domainName
 			}
+			route := Route{Domain: domainName}
+			route.Host, _ = entity["host"].(string)
+			route.Path, _ = entity["path"].(string)
+			route.Port, _ = entity["port"].(float64)
+			routes = append(routes, route)
+		}
+		if next, ok := routesJSON["next_url"].(string); ok {
+			nextURL = next
+		} else {
+			nextURL = ""
 		}
 	}
-	return services, nil
+	return routes, nil
 }
 
 func GetSecurityGroups(api *APIHelper, securityGroupURL string) (SecurityGroups, error) {
@@ -624,57 +1915,7 @@ func GetSecurityGroups(api *APIHelper, securityGroupURL string) (SecurityGroups,
 			return nil, err
 		}
 		for _, s := range securitygroupsJSON["resources"].([]interface{}) {
-			theSecurityGroup := s.(map[string]interface{})
-			entity := theSecurityGroup["entity"].(map[string]interface{})
-			rules := []Rule{}
-			for _, r := range entity["rules"].([]interface{}) {
-				rule := r.(map[string]interface{})
-				description := ""
-				if des, ok := rule["description"].(string); ok {
-					description = des
-				} else {
-					description = ""
-				}
-				destination := ""
-				if dest, ok := rule["destination"].(string); ok {
-					destination = dest
-				} else {
-					destination = ""
-				}
-				log := false
-				if lg, ok := rule["log"].(bool); ok {
-					log = lg
-				} else {
-					log = false
-				}
-				ports := ""
-				if pt, ok := rule["ports"].(string); ok {
-					ports = pt
-				} else {
-					ports = ""
-				}
-				protocol := ""
-				if pl, ok := rule["protocol"].(string); ok {
-					protocol = pl
-				} else {
-					protocol = ""
-				}
-				rules = append(rules,
-					Rule{
-						Description: description,
-						Destination: destination,
-						Log:         log,
-						Ports:       ports,
-						Protocol:    protocol,
-					})
-			}
-			securitygroups = append(securitygroups,
-				SecurityGroup{
-					Name:           entity["name"].(string),
-					Rules:          rules,
-					RunningDefault: entity["running_default"].(bool),
-					StagingDefault: entity["staging_default"].(bool),
-				})
+			securitygroups = append(securitygroups, securityGroupResourceToSecurityGroup(s))
 		}
 		if next, ok := securitygroupsJSON["next_url"].(string); ok {
 			nextURL = next
@@ -685,6 +1926,52 @@ func GetSecurityGroups(api *APIHelper, securityGroupURL string) (SecurityGroups,
 	return securitygroups, nil
 }
 
+func securityGroupResourceToSecurityGroup(s interface{}) SecurityGroup {
+	theSecurityGroup := s.(map[string]interface{})
+	entity := theSecurityGroup["entity"].(map[string]interface{})
+	rules := []Rule{}
+	rawRules, _ := entity["rules"].([]interface{})
+	for _, r := range rawRules {
+		rule := r.(map[string]interface{})
+		description := ""
+		if des, ok := rule["description"].(string); ok {
+			description = des
+		}
+		destination := ""
+		if dest, ok := rule["destination"].(string); ok {
+			destination = dest
+		}
+		log := false
+		if lg, ok := rule["log"].(bool); ok {
+			log = lg
+		}
+		ports := ""
+		if pt, ok := rule["ports"].(string); ok {
+			ports = pt
+		}
+		protocol := ""
+		if pl, ok := rule["protocol"].(string); ok {
+			protocol = pl
+		}
+		rules = append(rules,
+			Rule{
+				Description: description,
+				Destination: destination,
+				Log:         log,
+				Ports:       ports,
+				Protocol:    protocol,
+			})
+	}
+	runningDefault, _ := entity["running_default"].(bool)
+	stagingDefault, _ := entity["staging_default"].(bool)
+	return SecurityGroup{
+		Name:           entity["name"].(string),
+		Rules:          rules,
+		RunningDefault: runningDefault,
+		StagingDefault: stagingDefault,
+	}
+}
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -898,11 +2185,12 @@ func (api *APIHelper) CheckOrg(name string, create bool) (ImportedOrg, error) {
 		if nil != result {
 			metadata := result["metadata"].(map[string]interface{})
 			iorg = ImportedOrg{
-				Name: name,
-				Guid: metadata["guid"].(string),
+				Name:    name,
+				Guid:    metadata["guid"].(string),
+				Created: true,
 			}
 		}
-	} else {
+	} else if nil == err {
 		log.Println("Found existing org: " + name)
 		iorg = ImportedOrg{
 			Name: name,
@@ -912,12 +2200,182 @@ func (api *APIHelper) CheckOrg(name string, create bool) (ImportedOrg, error) {
 	return iorg, nil
 }
 
+type quotaInput struct {
+	Name                    string  `json:"name"`
+	NonBasicServicesAllowed bool    `json:"non_basic_services_allowed"`
+	TotalServices           float64 `json:"total_services"`
+	TotalRoutes             float64 `json:"total_routes"`
+	TotalPrivateDomain      float64 `json:"total_private_domains"`
+	MemoryLimit             float64 `json:"memory_limit"`
+	TrialDBAllowed          bool    `json:"trial_db_allowed"`
+	InstanceMemoryLimit     float64 `json:"instance_memory_limit"`
+	AppInstanceLimit        float64 `json:"app_instance_limit"`
+	AppTaskLimit            float64 `json:"app_task_limit"`
+	TotalServiceKeys        float64 `json:"total_service_keys"`
+	TotalReservedRoutePorts float64 `json:"total_reserved_route_ports"`
+}
+
+//CheckQuota looks up an org quota definition by name, creating it from the exported quota when missing.
+//The returned ImportedQuota carries the limits of the definition found on the target.
+func (api *APIHelper) CheckQuota(quota Quota, create bool) (ImportedQuota, error) {
+	var iquota ImportedQuota
+	log.Println("Looking for quota definition: " + quota.Name)
+	query := fmt.Sprintf("name:%s", quota.Name)
+	path := fmt.Sprintf("/v2/quota_definitions?q=%s", url.QueryEscape(query))
+	quotaJSON, err := cfcurl.Curl(api.cli, path)
+	if nil != err {
+		return iquota, err
+	}
+	total_results := int(quotaJSON["total_results"].(float64))
+	if total_results != 0 {
+		quotaResource := quotaJSON["resources"].([]interface{})[0]
+		theQuota := quotaResource.(map[string]interface{})
+		metadata := theQuota["metadata"].(map[string]interface{})
+		entity := theQuota["entity"].(map[string]interface{})
+		log.Println("Found existing quota definition: " + quota.Name)
+		return ImportedQuota{
+			Name:   quota.Name,
+			Guid:   metadata["guid"].(string),
+			Action: "found",
+			Quota:  quotaEntityToQuota(entity),
+		}, nil
+	}
+	if !create {
+		return iquota, nil
+	}
+	body := quotaInput{
+		Name:                    quota.Name,
+		NonBasicServicesAllowed: quota.NonBasicServicesAllowed,
+		TotalServices:           quota.TotalServices,
+		TotalRoutes:             quota.TotalRoutes,
+		TotalPrivateDomain:      quota.TotalPrivateDomain,
+		MemoryLimit:             quota.MemoryLimit,
+		TrialDBAllowed:          quota.TrialDBAllowed,
+		InstanceMemoryLimit:     quota.InstanceMemoryLimit,
+		AppInstanceLimit:        quota.AppInstanceLimit,
+		AppTaskLimit:            quota.AppTaskLimit,
+		TotalServiceKeys:        quota.TotalServiceKeys,
+		TotalReservedRoutePorts: quota.TotalReservedRoutePorts,
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Creating quota definition (" + quota.Name + ") with payload: " + string(bodyJSON))
+	result, err := httpRequest(api, "POST", "/v2/quota_definitions", string(bodyJSON))
+	if nil != err {
+		log.Println("Error creating quota definition: " + quota.Name)
+		return iquota, err
+	}
+	metadata := result["metadata"].(map[string]interface{})
+	log.Println("Quota definition " + quota.Name + " created.")
+	return ImportedQuota{
+		Name:   quota.Name,
+		Guid:   metadata["guid"].(string),
+		Action: "created",
+		Quota:  quota,
+	}, nil
+}
+
+//AssignOrgQuota sets the quota definition of an org
+func (api *APIHelper) AssignOrgQuota(orgguid string, quotaguid string) error {
+	bodyJSON := "{\"quota_definition_guid\":\"" + quotaguid + "\"}"
+	log.Println("Assigning quota definition to org (" + orgguid + ") with payload: " + bodyJSON)
+	_, err := httpRequest(api, "PUT", "/v2/organizations/"+orgguid, bodyJSON)
+	if nil != err {
+		log.Println("Error assigning quota definition (" + quotaguid + ") to org (" + orgguid + ")")
+		log.Println(err)
+	}
+	return err
+}
+
+type spaceQuotaInput struct {
+	Name                    string  `json:"name"`
+	OrgGuid                 string  `json:"organization_guid"`
+	NonBasicServicesAllowed bool    `json:"non_basic_services_allowed"`
+	TotalServices           float64 `json:"total_services"`
+	TotalRoutes             float64 `json:"total_routes"`
+	MemoryLimit             float64 `json:"memory_limit"`
+	InstanceMemoryLimit     float64 `json:"instance_memory_limit"`
+	AppInstanceLimit        float64 `json:"app_instance_limit"`
+	AppTaskLimit            float64 `json:"app_task_limit"`
+	TotalServiceKeys        float64 `json:"total_service_keys"`
+	TotalReservedRoutePorts float64 `json:"total_reserved_route_ports"`
+}
+
+//CheckSpaceQuota looks up a space quota definition by name within an org, creating it when missing
+func (api *APIHelper) CheckSpaceQuota(quota SpaceQuota, orgguid string, create bool) (ImportedQuota, error) {
+	var iquota ImportedQuota
+	log.Println("Looking for space quota definition: " + quota.Name)
+	query := fmt.Sprintf("name:%s", quota.Name)
+	path := fmt.Sprintf("/v2/organizations/"+orgguid+"/space_quota_definitions?q=%s", url.QueryEscape(query))
+	quotaJSON, err := cfcurl.Curl(api.cli, path)
+	if nil != err {
+		return iquota, err
+	}
+	total_results := int(quotaJSON["total_results"].(float64))
+	if total_results != 0 {
+		quotaResource := quotaJSON["resources"].([]interface{})[0]
+		metadata := quotaResource.(map[string]interface{})["metadata"].(map[string]interface{})
+		log.Println("Found existing space quota definition: " + quota.Name)
+		return ImportedQuota{
+			Name:   quota.Name,
+			Guid:   metadata["guid"].(string),
+			Action: "found",
+		}, nil
+	}
+	if !create {
+		return iquota, nil
+	}
+	body := spaceQuotaInput{
+		Name:                    quota.Name,
+		OrgGuid:                 orgguid,
+		NonBasicServicesAllowed: quota.NonBasicServicesAllowed,
+		TotalServices:           quota.TotalServices,
+		TotalRoutes:             quota.TotalRoutes,
+		MemoryLimit:             quota.MemoryLimit,
+		InstanceMemoryLimit:     quota.InstanceMemoryLimit,
+		AppInstanceLimit:        quota.AppInstanceLimit,
+		AppTaskLimit:            quota.AppTaskLimit,
+		TotalServiceKeys:        quota.TotalServiceKeys,
+		TotalReservedRoutePorts: quota.TotalReservedRoutePorts,
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Creating space quota definition (" + quota.Name + ") with payload: " + string(bodyJSON))
+	result, err := httpRequest(api, "POST", "/v2/space_quota_definitions", string(bodyJSON))
+	if nil != err {
+		log.Println("Error creating space quota definition: " + quota.Name)
+		return iquota, err
+	}
+	metadata := result["metadata"].(map[string]interface{})
+	log.Println("Space quota definition " + quota.Name + " created.")
+	return ImportedQuota{
+		Name:   quota.Name,
+		Guid:   metadata["guid"].(string),
+		Action: "created",
+	}, nil
+}
+
+//AssignSpaceQuota assigns a space quota definition to a space
+func (api *APIHelper) AssignSpaceQuota(quotaguid string, spaceguid string) error {
+	_, err := httpRequest(api, "PUT", "/v2/space_quota_definitions/"+quotaguid+"/spaces/"+spaceguid, "")
+	if nil != err {
+		log.Println("Error assigning space quota definition (" + quotaguid + ") to space (" + spaceguid + ")")
+		log.Println(err)
+	}
+	return err
+}
+
 type spaceInput struct {
-	Name string `json:"name"`
-	Guid string `json:"organization_guid"`
+	Name     string `json:"name"`
+	Guid     string `json:"organization_guid"`
+	AllowSsh *bool  `json:"allow_ssh,omitempty"`
+}
+
+type spaceSshInput struct {
+	AllowSsh bool `json:"allow_ssh"`
 }
 
-func (api *APIHelper) CheckSpace(name string, orgguid string, create bool) (ImportedSpace, error) {
+//CheckSpace looks for a space in the org, creating it when missing. With create, allow_ssh is also set on a found space,
+//a nil allowSsh keeps the platform default.
+func (api *APIHelper) CheckSpace(name string, orgguid string, allowSsh *bool, create bool) (ImportedSpace, error) {
 	var ispace ImportedSpace
 	var total_results int
 	log.Println("Looking for space: " + name)
@@ -928,8 +2386,9 @@ func (api *APIHelper) CheckSpace(name string, orgguid string, create bool) (Impo
 		total_results = int(spaceJSON["total_results"].(float64))
 		if total_results == 0 && create {
 			body := spaceInput{
-				Name: name,
-				Guid: orgguid,
+				Name:     name,
+				Guid:     orgguid,
+				AllowSsh: allowSsh,
 			}
 			bodyJSON, _ := json.Marshal(body)
 			log.Println("Creating space (" + name + ") with payload: " + string(bodyJSON))
@@ -944,8 +2403,9 @@ func (api *APIHelper) CheckSpace(name string, orgguid string, create bool) (Impo
 			if nil != result {
 				metadata := result["metadata"].(map[string]interface{})
 				ispace = ImportedSpace{
-					Name: name,
-					Guid: metadata["guid"].(string),
+					Name:    name,
+					Guid:    metadata["guid"].(string),
+					Created: true,
 				}
 			}
 		} else {
@@ -958,6 +2418,16 @@ func (api *APIHelper) CheckSpace(name string, orgguid string, create bool) (Impo
 					Name: name,
 					Guid: metadata["guid"].(string),
 				}
+				entity := theSpace["entity"].(map[string]interface{})
+				if currentlyAllowed, _ := entity["allow_ssh"].(bool); create && nil != allowSsh && currentlyAllowed != *allowSsh {
+					bodyJSON, _ := json.Marshal(spaceSshInput{AllowSsh: *allowSsh})
+					log.Println("Updating space (" + name + ") with payload: " + string(bodyJSON))
+					_, err := httpRequest(api, "PUT", "/v2/spaces/"+ispace.Guid, string(bodyJSON))
+					if nil != err {
+						log.Println("Error updating allow_ssh of space: " + name)
+						log.Println(err)
+					}
+				}
 			}
 		}
 	} else {
@@ -966,19 +2436,503 @@ func (api *APIHelper) CheckSpace(name string, orgguid string, create bool) (Impo
 		}
 	}
 
-	return ispace, nil
+	return ispace, nil
+}
+
+type ruleInput struct {
+	Protocol    string `json:"protocol"`
+	Destination string `json:"destination"`
+	Ports       string `json:"ports,omitempty"`
+	Log         bool   `json:"log,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type securityGroupInput struct {
+	Name  string      `json:"name,omitempty"`
+	Rules []ruleInput `json:"rules"`
+}
+
+func rulesToInput(rules Rules) []ruleInput {
+	input := []ruleInput{}
+	for _, r := range rules {
+		input = append(input, ruleInput{
+			Protocol:    r.Protocol,
+			Destination: r.Destination,
+			Ports:       r.Ports,
+			Log:         r.Log,
+			Description: r.Description,
+		})
+	}
+	return input
+}
+
+//sameRules compares two rule sets ignoring their order
+func sameRules(a Rules, b Rules) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[Rule]int)
+	for _, r := range a {
+		counts[r]++
+	}
+	for _, r := range b {
+		if counts[r] == 0 {
+			return false
+		}
+		counts[r]--
+	}
+	return true
+}
+
+//CheckSecurityGroup looks up an application security group by name, creating it when missing.
+//An existing group with different rules is only updated when update is true.
+func (api *APIHelper) CheckSecurityGroup(sg SecurityGroup, update bool) (ImportedSecurityGroup, error) {
+	var isg ImportedSecurityGroup
+	log.Println("Looking for security group: " + sg.Name)
+	query := fmt.Sprintf("name:%s", sg.Name)
+	path := fmt.Sprintf("/v2/security_groups?q=%s", url.QueryEscape(query))
+	sgJSON, err := cfcurl.Curl(api.cli, path)
+	if nil != err {
+		return isg, err
+	}
+	total_results := int(sgJSON["total_results"].(float64))
+	if total_results == 0 {
+		body := securityGroupInput{
+			Name:  sg.Name,
+			Rules: rulesToInput(sg.Rules),
+		}
+		bodyJSON, _ := json.Marshal(body)
+		log.Println("Creating security group (" + sg.Name + ") with payload: " + string(bodyJSON))
+		result, err := httpRequest(api, "POST", "/v2/security_groups", string(bodyJSON))
+		if nil != err {
+			log.Println("Error creating security group: " + sg.Name)
+			return isg, err
+		}
+		metadata := result["metadata"].(map[string]interface{})
+		log.Println("Security group " + sg.Name + " created.")
+		return ImportedSecurityGroup{
+			Name:   sg.Name,
+			Guid:   metadata["guid"].(string),
+			Action: "created",
+		}, nil
+	}
+
+	sgResource := sgJSON["resources"].([]interface{})[0]
+	metadata := sgResource.(map[string]interface{})["metadata"].(map[string]interface{})
+	isg = ImportedSecurityGroup{
+		Name:   sg.Name,
+		Guid:   metadata["guid"].(string),
+		Action: "found",
+	}
+	existing := securityGroupResourceToSecurityGroup(sgResource)
+	if sameRules(existing.Rules, sg.Rules) {
+		log.Println("Found existing security group: " + sg.Name)
+		return isg, nil
+	}
+	if !update {
+		log.Println("Found existing security group " + sg.Name + " with different rules, leaving it unchanged.")
+		isg.Action = "differs"
+		return isg, nil
+	}
+	body := securityGroupInput{
+		Rules: rulesToInput(sg.Rules),
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Updating security group (" + sg.Name + ") with payload: " + string(bodyJSON))
+	_, err = httpRequest(api, "PUT", "/v2/security_groups/"+isg.Guid, string(bodyJSON))
+	if nil != err {
+		log.Println("Error updating security group: " + sg.Name)
+		return isg, err
+	}
+	log.Println("Security group " + sg.Name + " updated.")
+	isg.Action = "updated"
+	return isg, nil
+}
+
+//BindSecurityGroup binds a security group to a space for the running or staging lifecycle
+func (api *APIHelper) BindSecurityGroup(sgguid string, spaceguid string, staging bool) error {
+	path := "/v2/security_groups/" + sgguid + "/spaces/" + spaceguid
+	if staging {
+		path = "/v2/security_groups/" + sgguid + "/staging_spaces/" + spaceguid
+	}
+	_, err := httpRequest(api, "PUT", path, "")
+	if nil != err {
+		log.Println("Problem binding security group (" + sgguid + ") to space (" + spaceguid + "): ")
+		log.Println(err)
+	}
+	return err
+}
+
+//SetDefaultSecurityGroup adds a security group to the platform running or staging default set
+func (api *APIHelper) SetDefaultSecurityGroup(sgguid string, staging bool) error {
+	path := "/v2/config/running_security_groups/" + sgguid
+	if staging {
+		path = "/v2/config/staging_security_groups/" + sgguid
+	}
+	_, err := httpRequest(api, "PUT", path, "")
+	if nil != err {
+		log.Println("Problem setting security group (" + sgguid + ") as platform default: ")
+		log.Println(err)
+	}
+	return err
+}
+
+type roleData struct {
+	Guid     string `json:"guid,omitempty"`
+	Username string `json:"username,omitempty"`
+	Origin   string `json:"origin,omitempty"`
+}
+
+type roleRelationship struct {
+	Data roleData `json:"data"`
+}
+
+type roleInput struct {
+	Type          string                      `json:"type"`
+	Relationships map[string]roleRelationship `json:"relationships"`
+}
+
+//AssignRole assigns an org role (spaceguid empty) or a space role to a user identified by username and origin.
+//It returns "assigned", "exists" or "missing" when the user does not exist on the target.
+func (api *APIHelper) AssignRole(role Role, orgguid string, spaceguid string) (string, error) {
+	path := "/v3/users?usernames=" + url.QueryEscape(role.Username)
+	if role.Origin != "" {
+		path = path + "&origins=" + url.QueryEscape(role.Origin)
+	}
+	usersJSON, err := cfcurl.Curl(api.cli, path)
+	if nil != err {
+		return "", err
+	}
+	if resources, ok := usersJSON["resources"].([]interface{}); !ok || len(resources) == 0 {
+		log.Println("User " + role.Username + " (" + role.Origin + ") not found, skipping role " + role.Type)
+		return "missing", nil
+	}
+	body := roleInput{
+		Type: role.Type,
+		Relationships: map[string]roleRelationship{
+			"user": {Data: roleData{Username: role.Username, Origin: role.Origin}},
+		},
+	}
+	if spaceguid != "" {
+		body.Relationships["space"] = roleRelationship{Data: roleData{Guid: spaceguid}}
+	} else {
+		body.Relationships["organization"] = roleRelationship{Data: roleData{Guid: orgguid}}
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Assigning role with payload: " + string(bodyJSON))
+	_, err = httpRequest(api, "POST", "/v3/roles", string(bodyJSON))
+	if nil != err {
+		if strings.Contains(err.Error(), "already") {
+			log.Println("User " + role.Username + " already has role " + role.Type)
+			return "exists", nil
+		}
+		log.Println("Error assigning role " + role.Type + " to user " + role.Username)
+		return "", err
+	}
+	log.Println("Role " + role.Type + " assigned to user " + role.Username + ".")
+	return "assigned", nil
+}
+
+type relationshipData struct {
+	Guid string `json:"guid"`
+}
+
+type relationshipInput struct {
+	Data relationshipData `json:"data"`
+}
+
+type relationshipsInput struct {
+	Data []relationshipData `json:"data"`
+}
+
+//EntitleIsolationSegment entitles an org to an isolation segment, entitling it again is a no-op
+func (api *APIHelper) EntitleIsolationSegment(segmentguid string, orgguid string) error {
+	body := relationshipsInput{
+		Data: []relationshipData{{Guid: orgguid}},
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Entitling org (" + orgguid + ") to isolation segment (" + segmentguid + ") with payload: " + string(bodyJSON))
+	_, err := httpRequest(api, "POST", "/v3/isolation_segments/"+segmentguid+"/relationships/organizations", string(bodyJSON))
+	if nil != err {
+		log.Println("Error entitling org (" + orgguid + ") to isolation segment (" + segmentguid + ")")
+		log.Println(err)
+	}
+	return err
+}
+
+//AssignIsolationSegment sets the default isolation segment of an org (spaceguid empty) or the isolation segment of a space.
+//The org must be entitled to the segment.
+func (api *APIHelper) AssignIsolationSegment(segmentguid string, orgguid string, spaceguid string) error {
+	path := "/v3/organizations/" + orgguid + "/relationships/default_isolation_segment"
+	if spaceguid != "" {
+		path = "/v3/spaces/" + spaceguid + "/relationships/isolation_segment"
+	}
+	body := relationshipInput{
+		Data: relationshipData{Guid: segmentguid},
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Assigning isolation segment with payload: " + string(bodyJSON) + " to " + path)
+	_, err := httpRequest(api, "PATCH", path, string(bodyJSON))
+	if nil != err {
+		log.Println("Error assigning isolation segment (" + segmentguid + ") to " + path)
+		log.Println(err)
+	}
+	return err
+}
+
+type serviceBrokerInput struct {
+	Name      string `json:"name"`
+	URL       string `json:"broker_url"`
+	Username  string `json:"auth_username"`
+	Password  string `json:"auth_password"`
+	SpaceGuid string `json:"space_guid"`
+}
+
+//CheckServiceBroker looks for a broker registered in the space, registering it when missing. Action is "created" or "found".
+func (api *APIHelper) CheckServiceBroker(broker ServiceBroker, password string, spaceguid string, create bool) (ImportedServiceBroker, error) {
+	ibroker := ImportedServiceBroker{
+		Name: broker.Name,
+	}
+	log.Println("Looking for service broker: " + broker.Name)
+	query1 := fmt.Sprintf("name:%s", broker.Name)
+	query2 := fmt.Sprintf("space_guid:%s", spaceguid)
+	path := fmt.Sprintf("/v2/service_brokers?q=%s&q=%s", url.QueryEscape(query1), url.QueryEscape(query2))
+	brokerJSON, err := cfcurl.Curl(api.cli, path)
+	if nil != err {
+		return ibroker, err
+	}
+	if resources, ok := brokerJSON["resources"].([]interface{}); ok && len(resources) > 0 {
+		metadata := resources[0].(map[string]interface{})["metadata"].(map[string]interface{})
+		log.Println("Found existing service broker: " + broker.Name)
+		ibroker.Guid = metadata["guid"].(string)
+		ibroker.Action = "found"
+		return ibroker, nil
+	}
+	if !create {
+		return ibroker, nil
+	}
+	body := serviceBrokerInput{
+		Name:      broker.Name,
+		URL:       broker.URL,
+		Username:  broker.Username,
+		Password:  password,
+		SpaceGuid: spaceguid,
+	}
+	bodyJSON, _ := json.Marshal(body)
+	body.Password = "[REDACTED]"
+	loggedJSON, _ := json.Marshal(body)
+	log.Println("Creating service broker (" + broker.Name + ") with payload: " + string(loggedJSON))
+	result, err := httpRequest(api, "POST", "/v2/service_brokers", string(bodyJSON))
+	if nil != err {
+		log.Println("Error creating service broker: " + broker.Name)
+		return ibroker, err
+	}
+	metadata := result["metadata"].(map[string]interface{})
+	log.Println("Service broker " + broker.Name + " created.")
+	ibroker.Guid = metadata["guid"].(string)
+	ibroker.Action = "created"
+	return ibroker, nil
+}
+
+type planVisibilityInput struct {
+	ServicePlanGuid  string `json:"service_plan_guid"`
+	OrganizationGuid string `json:"organization_guid"`
+}
+
+//AddPlanVisibility makes a service plan visible to an org, returning "added" or "exists"
+func (api *APIHelper) AddPlanVisibility(visibility PlanVisibility, orgguid string) (string, error) {
+	spguid, err := api.getServicePlanGuid(visibility.Service, visibility.Plan)
+	if nil != err {
+		return "", err
+	}
+	if len(spguid) < 1 {
+		return "", ErrManagedServicePlanNotFound
+	}
+	body := planVisibilityInput{
+		ServicePlanGuid:  spguid,
+		OrganizationGuid: orgguid,
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Adding service plan visibility with payload: " + string(bodyJSON))
+	_, err = httpRequest(api, "POST", "/v2/service_plan_visibilities", string(bodyJSON))
+	if nil != err {
+		if strings.Contains(err.Error(), "ServicePlanVisibilityAlreadyExists") {
+			return "exists", nil
+		}
+		log.Println("Error adding visibility of service plan " + visibility.Service + "/" + visibility.Plan)
+		return "", err
+	}
+	return "added", nil
+}
+
+//ShareServiceInstance shares a service instance into another space, returning "shared" or "exists"
+func (api *APIHelper) ShareServiceInstance(siguid string, spaceguid string) (string, error) {
+	sharedJSON, err := cfcurl.Curl(api.cli, "/v3/service_instances/"+siguid+"/relationships/shared_spaces")
+	if nil != err {
+		return "", err
+	}
+	if data, ok := sharedJSON["data"].([]interface{}); ok {
+		for _, d := range data {
+			if d.(map[string]interface{})["guid"] == spaceguid {
+				return "exists", nil
+			}
+		}
+	}
+	body := relationshipsInput{
+		Data: []relationshipData{{Guid: spaceguid}},
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Sharing service instance (" + siguid + ") with payload: " + string(bodyJSON))
+	_, err = httpRequest(api, "POST", "/v3/service_instances/"+siguid+"/relationships/shared_spaces", string(bodyJSON))
+	if nil != err {
+		log.Println("Error sharing service instance (" + siguid + ") into space (" + spaceguid + ")")
+		return "", err
+	}
+	return "shared", nil
+}
+
+type buildpackInput struct {
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+	Enabled  bool   `json:"enabled"`
+	Stack    string `json:"stack,omitempty"`
+}
+
+//CheckBuildpack looks for an admin buildpack by name and stack, creating it unlocked and without bits when missing.
+//Action is "created" or "found".
+func (api *APIHelper) CheckBuildpack(buildpack Buildpack, create bool) (ImportedBuildpack, error) {
+	ibuildpack := ImportedBuildpack{
+		Name:  buildpack.Name,
+		Stack: buildpack.Stack,
+	}
+	log.Println("Looking for buildpack: " + buildpack.Name + " (" + buildpack.Stack + ")")
+	buildpacksJSON, err := cfcurl.Curl(api.cli, "/v3/buildpacks?names="+url.QueryEscape(buildpack.Name))
+	if nil != err {
+		return ibuildpack, err
+	}
+	if resources, ok := buildpacksJSON["resources"].([]interface{}); ok {
+		for _, b := range resources {
+			theBuildpack := b.(map[string]interface{})
+			if stack, _ := theBuildpack["stack"].(string); stack == buildpack.Stack {
+				log.Println("Found existing buildpack: " + buildpack.Name + " (" + buildpack.Stack + ")")
+				ibuildpack.Guid = theBuildpack["guid"].(string)
+				ibuildpack.Action = "found"
+				return ibuildpack, nil
+			}
+		}
+	}
+	if !create {
+		return ibuildpack, nil
+	}
+	body := buildpackInput{
+		Name:     buildpack.Name,
+		Position: int(buildpack.Position),
+		Enabled:  buildpack.Enabled,
+		Stack:    buildpack.Stack,
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Creating buildpack (" + buildpack.Name + ") with payload: " + string(bodyJSON))
+	result, err := httpRequest(api, "POST", "/v2/buildpacks", string(bodyJSON))
+	if nil != err {
+		log.Println("Error creating buildpack: " + buildpack.Name)
+		return ibuildpack, err
+	}
+	metadata := result["metadata"].(map[string]interface{})
+	ibuildpack.Guid = metadata["guid"].(string)
+	ibuildpack.Action = "created"
+	return ibuildpack, nil
+}
+
+//UploadBuildpack uploads the bits of an admin buildpack and reports whether the upload succeeded
+func (api *APIHelper) UploadBuildpack(buildpackguid string, filename string) error {
+	msg, err := putBuildpack(api, "/v2/buildpacks/"+buildpackguid+"/bits", filename)
+	log.Println(msg)
+	return err
+}
+
+//LockBuildpack locks an admin buildpack, its bits have to be uploaded first
+func (api *APIHelper) LockBuildpack(buildpackguid string) error {
+	log.Println("Locking buildpack (" + buildpackguid + ") with payload: {\"locked\":true}")
+	_, err := httpRequest(api, "PUT", "/v2/buildpacks/"+buildpackguid, "{\"locked\":true}")
+	if nil != err {
+		log.Println("Error locking buildpack: " + buildpackguid)
+		log.Println(err)
+	}
+	return err
+}
+
+type privateDomainInput struct {
+	Name    string `json:"name"`
+	OrgGuid string `json:"owning_organization_guid"`
+}
+
+//CheckPrivateDomain looks up a private domain by name, creating it under the given owning org when missing
+func (api *APIHelper) CheckPrivateDomain(name string, orgguid string, create bool) (ImportedDomain, error) {
+	var idomain ImportedDomain
+	log.Println("Looking for private domain: " + name)
+	query := fmt.Sprintf("name:%s", name)
+	path := fmt.Sprintf("/v2/private_domains?q=%s", url.QueryEscape(query))
+	domainJSON, err := cfcurl.Curl(api.cli, path)
+	if nil != err {
+		return idomain, err
+	}
+	total_results := int(domainJSON["total_results"].(float64))
+	if total_results != 0 {
+		domainResource := domainJSON["resources"].([]interface{})[0]
+		metadata := domainResource.(map[string]interface{})["metadata"].(map[string]interface{})
+		log.Println("Found existing private domain: " + name)
+		return ImportedDomain{
+			Name:   name,
+			Guid:   metadata["guid"].(string),
+			Action: "found",
+		}, nil
+	}
+	if !create {
+		return idomain, nil
+	}
+	body := privateDomainInput{
+		Name:    name,
+		OrgGuid: orgguid,
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Creating private domain (" + name + ") with payload: " + string(bodyJSON))
+	result, err := httpRequest(api, "POST", "/v2/private_domains", string(bodyJSON))
+	if nil != err {
+		log.Println("Error creating private domain: " + name)
+		return idomain, err
+	}
+	metadata := result["metadata"].(map[string]interface{})
+	log.Println("Private domain " + name + " created.")
+	return ImportedDomain{
+		Name:   name,
+		Guid:   metadata["guid"].(string),
+		Action: "created",
+	}, nil
+}
+
+//SharePrivateDomain shares a private domain with an org other than its owner
+func (api *APIHelper) SharePrivateDomain(domainguid string, orgguid string) error {
+	_, err := httpRequest(api, "PUT", "/v2/organizations/"+orgguid+"/private_domains/"+domainguid, "")
+	if nil != err {
+		log.Println("Error sharing private domain (" + domainguid + ") with org (" + orgguid + ")")
+		log.Println(err)
+	}
+	return err
 }
 
 type serviceInput struct {
-	Name            string `json:"name"`
-	SpaceGuid       string `json:"space_guid"`
-	ServicePlanGuid string `json:"service_plan_guid"`
+	Name            string                 `json:"name"`
+	SpaceGuid       string                 `json:"space_guid"`
+	ServicePlanGuid string                 `json:"service_plan_guid"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	Tags            []string               `json:"tags,omitempty"`
 }
 type cupsInput struct {
-	Name        string                 `json:"name"`
-	SpaceGuid   string                 `json:"space_guid"`
-	Credentials map[string]interface{} `json:"credentials"`
-	SyslogDrain string                 `json:"syslog_drain_url"`
+	Name            string                 `json:"name"`
+	SpaceGuid       string                 `json:"space_guid"`
+	Credentials     map[string]interface{} `json:"credentials"`
+	SyslogDrain     string                 `json:"syslog_drain_url"`
+	RouteServiceURL string                 `json:"route_service_url,omitempty"`
 }
 
 func (api *APIHelper) CheckServiceInstance(service Service, spaceguid string, create bool) (ImportedService, error) {
@@ -993,16 +2947,22 @@ func (api *APIHelper) CheckServiceInstance(service Service, spaceguid string, cr
 		if len(siguid) > 1 {
 			create = false
 			iservice = ImportedService{
-				Name: service.InstanceName,
-				Guid: siguid,
+				Name:  service.InstanceName,
+				Guid:  siguid,
+				State: "succeeded",
 			}
-			log.Println("Service instance " + service.InstanceName + " found.")
+			if siJSON, err := cfcurl.Curl(api.cli, "/v2/service_instances/"+siguid); nil == err {
+				iservice.State = lastOperationState(siJSON)
+			}
+			log.Println("Service instance " + service.InstanceName + " found (" + iservice.State + ").")
 		}
 		if create {
 			body := serviceInput{
 				Name:            service.InstanceName,
 				SpaceGuid:       spaceguid,
 				ServicePlanGuid: spguid,
+				Parameters:      service.Parameters,
+				Tags:            service.Tags,
 			}
 			bodyJSON, _ := json.Marshal(body)
 			log.Println("Creating service instance " + service.InstanceName + " with payload: " + string(bodyJSON))
@@ -1010,14 +2970,20 @@ func (api *APIHelper) CheckServiceInstance(service Service, spaceguid string, cr
 			if nil != err {
 				log.Println("Error creating service instance: " + service.InstanceName)
 				log.Println(err)
+				iservice = ImportedService{
+					Name:  service.InstanceName,
+					State: "failed",
+				}
 			}
 			if nil != result {
 				metadata := result["metadata"].(map[string]interface{})
 				iservice = ImportedService{
-					Name: service.InstanceName,
-					Guid: metadata["guid"].(string),
+					Name:  service.InstanceName,
+					Guid:  metadata["guid"].(string),
+					State: lastOperationState(result),
+					Created: true,
 				}
-				log.Println("Service instance " + service.InstanceName + " created.")
+				log.Println("Service instance " + service.InstanceName + " created (" + iservice.State + ").")
 			}
 		}
 	}
@@ -1026,17 +2992,19 @@ func (api *APIHelper) CheckServiceInstance(service Service, spaceguid string, cr
 		if len(siguid) > 1 {
 			create = false
 			iservice = ImportedService{
-				Name: service.InstanceName,
-				Guid: siguid,
+				Name:  service.InstanceName,
+				Guid:  siguid,
+				State: "succeeded",
 			}
 			log.Println("Service instance " + service.InstanceName + " found.")
 		}
 		if create {
 			body := cupsInput{
-				Name:        service.InstanceName,
-				SpaceGuid:   spaceguid,
-				Credentials: service.Credentials,
-				SyslogDrain: service.SyslogDrain,
+				Name:            service.InstanceName,
+				SpaceGuid:       spaceguid,
+				Credentials:     service.Credentials,
+				SyslogDrain:     service.SyslogDrain,
+				RouteServiceURL: service.RouteServiceURL,
 			}
 			bodyJSON, _ := json.Marshal(body)
 			log.Println("Creating service instance " + service.InstanceName + " with payload: " + string(bodyJSON))
@@ -1048,11 +3016,18 @@ func (api *APIHelper) CheckServiceInstance(service Service, spaceguid string, cr
 			if nil != result {
 				metadata := result["metadata"].(map[string]interface{})
 				iservice = ImportedService{
-					Name: service.InstanceName,
-					Guid: metadata["guid"].(string),
+					Name:  service.InstanceName,
+					Guid:  metadata["guid"].(string),
+					State: "succeeded",
+					Created: true,
 				}
 				log.Println("Service instance " + service.InstanceName + " created.")
 
+			} else {
+				iservice = ImportedService{
+					Name:  service.InstanceName,
+					State: "failed",
+				}
 			}
 		}
 	}
@@ -1060,15 +3035,189 @@ func (api *APIHelper) CheckServiceInstance(service Service, spaceguid string, cr
 	return iservice, nil
 }
 
+//lastOperationState returns the state of the last operation of a v2 service instance resource:
+//"in progress", "succeeded" or "failed". Error responses and resources without entity are reported as "failed".
+func lastOperationState(siJSON map[string]interface{}) string {
+	if _, ok := siJSON["error_code"]; ok {
+		return "failed"
+	}
+	entity, ok := siJSON["entity"].(map[string]interface{})
+	if !ok {
+		return "failed"
+	}
+	lastOperation, ok := entity["last_operation"].(map[string]interface{})
+	if !ok {
+		return "succeeded"
+	}
+	state, ok := lastOperation["state"].(string)
+	if !ok {
+		return "succeeded"
+	}
+	return state
+}
+
+//WaitForServiceInstance polls the last operation of a service instance until it is no longer
+//in progress or the deadline has passed, and returns its last state
+func (api *APIHelper) WaitForServiceInstance(siguid string, deadline time.Time) (string, error) {
+	for {
+		siJSON, err := cfcurl.Curl(api.cli, "/v2/service_instances/"+siguid)
+		if nil != err {
+			return "", err
+		}
+		state := lastOperationState(siJSON)
+		if state != "in progress" || time.Now().After(deadline) {
+			return state, nil
+		}
+		log.Println("Waiting for service instance (" + siguid + ") to be provisioned ...")
+		time.Sleep(10 * time.Second)
+	}
+}
+
+//BindRouteService binds a route to a route service instance, creating the route when it does not exist yet
+func (api *APIHelper) BindRouteService(siguid string, stype string, route Route, spaceguid string) error {
+	domainguid, err := api.GetDomainGuid(route.Domain)
+	if nil != err {
+		log.Println("Problem binding route (" + routeURL(route) + ") to service instance (" + siguid + "), domain not found: ")
+		log.Println(err)
+		return err
+	}
+	routeguid, err := api.createRoute(domainguid, spaceguid, route)
+	if nil == err && routeguid == "" {
+		err = fmt.Errorf("route %s not created", routeURL(route))
+	}
+	if nil != err {
+		log.Println("Problem binding route (" + routeURL(route) + ") to service instance (" + siguid + "), route not available: ")
+		log.Println(err)
+		return err
+	}
+	path := "/v2/service_instances/" + siguid + "/routes/" + routeguid
+	if stype == "user_provided" {
+		path = "/v2/user_provided_service_instances/" + siguid + "/routes/" + routeguid
+	}
+	_, err = httpRequest(api, "PUT", path, "")
+	if nil != err {
+		log.Println("Problem binding route (" + routeURL(route) + ") to service instance (" + siguid + "): ")
+		log.Println(err)
+		return err
+	}
+	log.Println("Route (" + routeURL(route) + ") bound to route service instance (" + siguid + ").")
+	return nil
+}
+
+type serviceKeyInput struct {
+	Name                string                 `json:"name"`
+	ServiceInstanceGuid string                 `json:"service_instance_guid"`
+	Parameters          map[string]interface{} `json:"parameters,omitempty"`
+}
+
+//CheckServiceKey looks up a service key of a service instance by name, creating it when missing.
+//The returned ImportedServiceKey carries the key credentials issued by the target broker.
+func (api *APIHelper) CheckServiceKey(key ServiceKey, siguid string, create bool) (ImportedServiceKey, error) {
+	var ikey ImportedServiceKey
+	query1 := fmt.Sprintf("name:%s", key.Name)
+	query2 := fmt.Sprintf("service_instance_guid:%s", siguid)
+	path := fmt.Sprintf("/v2/service_keys?q=%s&q=%s", url.QueryEscape(query1), url.QueryEscape(query2))
+	keyJSON, err := cfcurl.Curl(api.cli, path)
+	if nil != err {
+		return ikey, err
+	}
+	var theKey map[string]interface{}
+	total_results := int(keyJSON["total_results"].(float64))
+	if total_results != 0 {
+		theKey = keyJSON["resources"].([]interface{})[0].(map[string]interface{})
+		log.Println("Service key " + key.Name + " found.")
+	} else {
+		if !create {
+			return ikey, nil
+		}
+		body := serviceKeyInput{
+			Name:                key.Name,
+			ServiceInstanceGuid: siguid,
+			Parameters:          key.Parameters,
+		}
+		bodyJSON, _ := json.Marshal(body)
+		log.Println("Creating service key " + key.Name + " with payload: " + string(bodyJSON))
+		theKey, err = httpRequest(api, "POST", "/v2/service_keys", string(bodyJSON))
+		if nil != err {
+			log.Println("Error creating service key: " + key.Name)
+			return ikey, err
+		}
+		log.Println("Service key " + key.Name + " created.")
+	}
+	metadata := theKey["metadata"].(map[string]interface{})
+	entity := theKey["entity"].(map[string]interface{})
+	credentials, _ := entity["credentials"].(map[string]interface{})
+	return ImportedServiceKey{
+		Name:        key.Name,
+		Guid:        metadata["guid"].(string),
+		Credentials: credentials,
+	}, nil
+}
+
+type policyPortsInput struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type policySourceInput struct {
+	Id string `json:"id"`
+}
+
+type policyDestinationInput struct {
+	Id       string           `json:"id"`
+	Protocol string           `json:"protocol"`
+	Ports    policyPortsInput `json:"ports"`
+}
+
+type policyInput struct {
+	Source      policySourceInput      `json:"source"`
+	Destination policyDestinationInput `json:"destination"`
+}
+
+type policiesInput struct {
+	Policies []policyInput `json:"policies"`
+}
+
+//CreateNetworkPolicies creates container-to-container network policies, existing policies are left as they are
+func (api *APIHelper) CreateNetworkPolicies(policies NetworkPolicies) error {
+	body := policiesInput{Policies: []policyInput{}}
+	for _, p := range policies {
+		body.Policies = append(body.Policies, policyInput{
+			Source: policySourceInput{Id: p.SourceGuid},
+			Destination: policyDestinationInput{
+				Id:       p.DestinationGuid,
+				Protocol: p.Protocol,
+				Ports: policyPortsInput{
+					Start: int(p.StartPort),
+					End:   int(p.EndPort),
+				},
+			},
+		})
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Creating network policies with payload: " + string(bodyJSON))
+	_, err := httpRequest(api, "POST", "/networking/v1/external/policies", string(bodyJSON))
+	if nil != err {
+		log.Println("Error creating network policies")
+		log.Println(err)
+	}
+	return err
+}
+
 type serviceBindingInput struct {
-	ServiceInstanceGuid string `json:"service_instance_guid"`
-	AppGuid             string `json:"app_guid"`
+	ServiceInstanceGuid string                 `json:"service_instance_guid"`
+	AppGuid             string                 `json:"app_guid"`
+	Name                string                 `json:"name,omitempty"`
+	Parameters          map[string]interface{} `json:"parameters,omitempty"`
 }
 
-func (api *APIHelper) bindService(siguid string, appguid string) error {
+//BindService binds a service instance to an app with the binding's name and parameters
+func (api *APIHelper) BindService(siguid string, appguid string, binding ServiceBinding) error {
 	body := serviceBindingInput{
 		ServiceInstanceGuid: siguid,
 		AppGuid:             appguid,
+		Name:                binding.Name,
+		Parameters:          binding.Parameters,
 	}
 	bodyJSON, _ := json.Marshal(body)
 	_, err := httpRequest(api, "POST", "/v2/service_bindings", string(bodyJSON))
@@ -1076,7 +3225,7 @@ func (api *APIHelper) bindService(siguid string, appguid string) error {
 		log.Println("Problem binding service instance (" + siguid + ") to app instance (" + appguid + "): ")
 		log.Println(err)
 	}
-	return nil
+	return err
 }
 
 type appInput struct {
@@ -1093,6 +3242,14 @@ type appInput struct {
 	Diego                   bool                   `json:"diego"`
 	EnableSsh               bool                   `json:"enable_ssh"`
 	EnviornmentVar          map[string]interface{} `json:"environment_json"`
+	Ports                   []float64              `json:"ports,omitempty"`
+	DockerImage             string                 `json:"docker_image,omitempty"`
+	DockerCredentials       *dockerCredentialsInput `json:"docker_credentials,omitempty"`
+}
+
+type dockerCredentialsInput struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 func (api *APIHelper) CheckApp(mapp App, rservices IServices, spaceguid string, create bool) (ImportedApp, error) {
@@ -1121,9 +3278,29 @@ func (api *APIHelper) CheckApp(mapp App, rservices IServices, spaceguid string,
 				Diego:          mapp.Diego,
 				EnableSsh:      mapp.EnableSsh,
 				EnviornmentVar: mapp.EnviornmentVar,
+				Ports:          mapp.Ports,
+				DockerImage:    mapp.DockerImage,
+			}
+			if mapp.DockerUsername != "" {
+				if mapp.DockerPassword == "" {
+					log.Println("Warning: no registry password supplied for Docker app " + mapp.Name + ", set CF_DOCKER_PASSWORD.")
+				}
+				body.DockerCredentials = &dockerCredentialsInput{
+					Username: mapp.DockerUsername,
+					Password: mapp.DockerPassword,
+				}
 			}
 			bodyJSON, _ := json.Marshal(body)
-			log.Println("Creating app (" + mapp.Name + ") with payload: " + string(bodyJSON))
+			loggedJSON := bodyJSON
+			if body.DockerCredentials != nil {
+				logged := body
+				logged.DockerCredentials = &dockerCredentialsInput{
+					Username: body.DockerCredentials.Username,
+					Password: "[REDACTED]",
+				}
+				loggedJSON, _ = json.Marshal(logged)
+			}
+			log.Println("Creating app (" + mapp.Name + ") with payload: " + string(loggedJSON))
 			result, err := httpRequest(api, "POST", "/v2/apps", string(bodyJSON))
 			if nil != err {
 				log.Println("Error creating app: " + mapp.Name)
@@ -1137,23 +3314,51 @@ func (api *APIHelper) CheckApp(mapp App, rservices IServices, spaceguid string,
 					Droplet: url.PathEscape(mapp.Name) + "_" + mapp.Guid + ".droplet",
 					Src:     url.PathEscape(mapp.Name) + "_" + mapp.Guid + ".src",
 					OrgState: mapp.State,
+					Docker:   mapp.DockerImage != "",
+					Created:  true,
 				}
 				log.Println("App " + mapp.Name + " created.")
 			}
-			for _, url := range mapp.URLs {
-				s := strings.SplitN(url.(string), ".", 2)
-				domainguid, err := api.GetDomainGuid(s[1])
+			if iapp.Guid != "" && mapp.DockerImage == "" {
+				api.setAppLifecycle(mapp, iapp.Guid)
+			}
+			if iapp.Guid != "" {
+				api.createSidecars(mapp, iapp.Guid)
+			}
+			for _, route := range mapp.Routes {
+				domainguid, err := api.GetDomainGuid(route.Domain)
+				if err == ErrDomainNotFound && route.RouterGroup != "" {
+					domainguid, err = api.createTCPDomain(route.Domain, route.RouterGroup)
+				}
 				check(err)
-				routeguid, err := api.createRoute(domainguid, spaceguid, s[0])
+				routeguid, err := api.createRoute(domainguid, spaceguid, route)
 				check(err)
-				log.Println("Route (" + url.(string) + ") created.")
-				api.bindRoute(routeguid, iapp.Guid)
-				log.Println("Route (" + url.(string) + ") bounded to app " + mapp.Name + ".")
+				log.Println("Route (" + routeURL(route) + ") created.")
+				api.mapRoute(routeguid, iapp.Guid, route.AppPort)
+				log.Println("Route (" + routeURL(route) + ") bounded to app " + mapp.Name + ".")
 			}
 			for _, siname := range mapp.ServiceNames {
-				siguid, err := getServiceInstanceGuid(rservices, siname.(string))
+				rservice, err := getServiceInstance(rservices, siname.(string))
 				check(err)
-				api.bindService(siguid, iapp.Guid)
+				if rservice.State == "shared" {
+					log.Println("Service instance (" + siname.(string) + ") is shared from another space, deferring binding to app " + mapp.Name + ".")
+					iapp.DeferredServices = append(iapp.DeferredServices, siname.(string))
+					continue
+				}
+				if rservice.State == "in progress" {
+					log.Println("Service instance (" + siname.(string) + ") is still being provisioned, deferring binding to app " + mapp.Name + ".")
+					iapp.DeferredServices = append(iapp.DeferredServices, siname.(string))
+					continue
+				}
+				if rservice.State == "failed" {
+					log.Println("Service instance (" + siname.(string) + ") failed to provision, not binding it to app " + mapp.Name + ".")
+					iapp.FailedServices = append(iapp.FailedServices, siname.(string))
+					continue
+				}
+				if nil != api.BindService(rservice.Guid, iapp.Guid, mapp.ServiceBindings.Find(siname.(string))) {
+					iapp.FailedServices = append(iapp.FailedServices, siname.(string))
+					continue
+				}
 				log.Println("Service instance (" + siname.(string) + ") bounded to app " + mapp.Name + ".")
 			}
 		} else {
@@ -1168,6 +3373,7 @@ func (api *APIHelper) CheckApp(mapp App, rservices IServices, spaceguid string,
 					Droplet: url.PathEscape(mapp.Name) + "_" + mapp.Guid + ".droplet",
 					Src:     url.PathEscape(mapp.Name) + "_" + mapp.Guid + ".src",
 					OrgState: mapp.State,
+					Docker:   mapp.DockerImage != "",
 				}
 			}
 		}
@@ -1178,11 +3384,253 @@ func (api *APIHelper) CheckApp(mapp App, rservices IServices, spaceguid string,
 			Droplet: url.PathEscape(mapp.Name) + "_" + mapp.Guid + ".droplet",
 			Src:     url.PathEscape(mapp.Name) + "_" + mapp.Guid + ".src",
 			OrgState: mapp.State,
+			Docker:   mapp.DockerImage != "",
 		}
 	}
 	return iapp, nil
 }
 
+type lifecycleDataInput struct {
+	Buildpacks []string `json:"buildpacks"`
+	Stack      string   `json:"stack,omitempty"`
+}
+
+type lifecycleInput struct {
+	Type string             `json:"type"`
+	Data lifecycleDataInput `json:"data"`
+}
+
+type appLifecycleInput struct {
+	Lifecycle lifecycleInput `json:"lifecycle"`
+}
+
+//setAppLifecycle sets the exported buildpacks and stack on an app, warning about the ones missing on the target
+func (api *APIHelper) setAppLifecycle(mapp App, appguid string) {
+	buildpacks := []string{}
+	for _, buildpack := range mapp.Buildpacks {
+		// custom buildpacks given by URL are not registered on the platform
+		if strings.Contains(buildpack, "://") || api.exists("/v2/buildpacks", buildpack) {
+			buildpacks = append(buildpacks, buildpack)
+		} else {
+			log.Println("Warning: buildpack " + buildpack + " of app " + mapp.Name + " not found on target.")
+		}
+	}
+	if len(mapp.Buildpacks) == 0 && mapp.DetectedBuildpack != "" && !api.exists("/v2/buildpacks", mapp.DetectedBuildpack) {
+		log.Println("Warning: detected buildpack " + mapp.DetectedBuildpack + " " + mapp.BuildpackVersion + " of app " + mapp.Name + " not found on target.")
+	}
+	stack := mapp.Stack
+	if stack != "" && !api.exists("/v2/stacks", stack) {
+		log.Println("Warning: stack " + stack + " of app " + mapp.Name + " not found on target.")
+		stack = ""
+	}
+	if len(buildpacks) == 0 && stack == "" {
+		return
+	}
+	body := appLifecycleInput{
+		Lifecycle: lifecycleInput{
+			Type: "buildpack",
+			Data: lifecycleDataInput{
+				Buildpacks: buildpacks,
+				Stack:      stack,
+			},
+		},
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Setting lifecycle of app (" + mapp.Name + ") with payload: " + string(bodyJSON))
+	_, err := httpRequest(api, "PATCH", "/v3/apps/"+appguid, string(bodyJSON))
+	if nil != err {
+		log.Println("Error setting lifecycle of app: " + mapp.Name)
+		log.Println(err)
+	}
+}
+
+//exists reports whether a v2 resource with the given name exists under resourceURL
+func (api *APIHelper) exists(resourceURL string, name string) bool {
+	query := fmt.Sprintf("name:%s", name)
+	resourceJSON, err := cfcurl.Curl(api.cli, fmt.Sprintf(resourceURL+"?q=%s", url.QueryEscape(query)))
+	if nil != err {
+		log.Println(err)
+		return false
+	}
+	total_results, ok := resourceJSON["total_results"].(float64)
+	return ok && total_results > 0
+}
+
+type sidecarInput struct {
+	Name         string   `json:"name"`
+	Command      string   `json:"command"`
+	ProcessTypes []string `json:"process_types"`
+	Memory       int      `json:"memory_in_mb,omitempty"`
+}
+
+//createSidecars recreates the exported sidecars of an app
+func (api *APIHelper) createSidecars(mapp App, appguid string) {
+	for _, sidecar := range mapp.Sidecars {
+		body := sidecarInput{
+			Name:         sidecar.Name,
+			Command:      sidecar.Command,
+			ProcessTypes: sidecar.ProcessTypes,
+			Memory:       int(sidecar.Memory),
+		}
+		bodyJSON, _ := json.Marshal(body)
+		log.Println("Creating sidecar " + sidecar.Name + " of app (" + mapp.Name + ") with payload: " + string(bodyJSON))
+		_, err := httpRequest(api, "POST", "/v3/apps/"+appguid+"/sidecars", string(bodyJSON))
+		if nil != err {
+			log.Println("Error creating sidecar " + sidecar.Name + " of app: " + mapp.Name)
+			log.Println(err)
+		}
+	}
+}
+
+type processScaleInput struct {
+	Instances int `json:"instances"`
+	Memory    int `json:"memory_in_mb"`
+	DiskQuota int `json:"disk_in_mb"`
+}
+
+type healthCheckDataInput struct {
+	Timeout           int    `json:"timeout,omitempty"`
+	InvocationTimeout int    `json:"invocation_timeout,omitempty"`
+	Endpoint          string `json:"endpoint,omitempty"`
+}
+
+type healthCheckInput struct {
+	Type string               `json:"type"`
+	Data healthCheckDataInput `json:"data"`
+}
+
+type processInput struct {
+	Command     string            `json:"command,omitempty"`
+	HealthCheck *healthCheckInput `json:"health_check,omitempty"`
+}
+
+//WaitForDroplet polls the current droplet of an app until the uploaded droplet is assigned and staged,
+//so the processes it declares exist, or the deadline has passed
+func (api *APIHelper) WaitForDroplet(appguid string, deadline time.Time) error {
+	for {
+		dropletJSON, err := cfcurl.Curl(api.cli, "/v3/apps/"+appguid+"/droplets/current")
+		if nil != err {
+			return err
+		}
+		if state, _ := dropletJSON["state"].(string); state == "STAGED" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("droplet of app (%s) not ready in time", appguid)
+		}
+		log.Println("Waiting for droplet of app (" + appguid + ") to be processed ...")
+		time.Sleep(10 * time.Second)
+	}
+}
+
+//ScaleProcess applies the exported scale, command and health check to a process type of an app.
+//Process types only exist once the app has a droplet.
+func (api *APIHelper) ScaleProcess(appguid string, process Process) error {
+	processJSON, err := cfcurl.Curl(api.cli, "/v3/apps/"+appguid+"/processes/"+process.Type)
+	if nil != err {
+		return err
+	}
+	processGuid, ok := processJSON["guid"].(string)
+	if !ok {
+		log.Println("Process type " + process.Type + " not found for app (" + appguid + "), skipping scale.")
+		return ErrProcessNotFound
+	}
+	scale := processScaleInput{
+		Instances: int(process.Instances),
+		Memory:    int(process.Memory),
+		DiskQuota: int(process.DiskQuota),
+	}
+	bodyJSON, _ := json.Marshal(scale)
+	log.Println("Scaling process " + process.Type + " of app (" + appguid + ") with payload: " + string(bodyJSON))
+	_, err = httpRequest(api, "POST", "/v3/processes/"+processGuid+"/actions/scale", string(bodyJSON))
+	if nil != err {
+		log.Println("Error scaling process " + process.Type + " of app (" + appguid + ")")
+		log.Println(err)
+		return err
+	}
+	body := processInput{
+		Command: process.Command,
+	}
+	if process.HealthCheckType != "" {
+		body.HealthCheck = &healthCheckInput{
+			Type: process.HealthCheckType,
+			Data: healthCheckDataInput{
+				Timeout:           int(process.HealthCheckTimeout),
+				InvocationTimeout: int(process.HealthCheckInvocationTimeout),
+				Endpoint:          process.HealthCheckHttpEndpoint,
+			},
+		}
+	}
+	bodyJSON, _ = json.Marshal(body)
+	log.Println("Updating process " + process.Type + " of app (" + appguid + ") with payload: " + string(bodyJSON))
+	_, err = httpRequest(api, "PATCH", "/v3/processes/"+processGuid, string(bodyJSON))
+	if nil != err {
+		log.Println("Error updating process " + process.Type + " of app (" + appguid + ")")
+		log.Println(err)
+	}
+	return err
+}
+
+type metadataValuesInput struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type metadataInput struct {
+	Metadata metadataValuesInput `json:"metadata"`
+}
+
+//SetMetadata adds labels and annotations to a v3 resource, keeping the ones already set on it
+func (api *APIHelper) SetMetadata(resourceURL string, metadata Metadata) error {
+	body := metadataInput{
+		Metadata: metadataValuesInput{
+			Labels:      metadata.Labels,
+			Annotations: metadata.Annotations,
+		},
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Setting metadata of " + resourceURL + " with payload: " + string(bodyJSON))
+	_, err := httpRequest(api, "PATCH", resourceURL, string(bodyJSON))
+	if nil != err {
+		log.Println("Error setting metadata of " + resourceURL)
+		log.Println(err)
+	}
+	return err
+}
+
+type featureFlagInput struct {
+	Enabled bool `json:"enabled"`
+}
+
+//SetFeatureFlag enables or disables a feature flag
+func (api *APIHelper) SetFeatureFlag(name string, enabled bool) error {
+	bodyJSON, _ := json.Marshal(featureFlagInput{Enabled: enabled})
+	log.Println("Setting feature flag " + name + " with payload: " + string(bodyJSON))
+	_, err := httpRequest(api, "PATCH", "/v3/feature_flags/"+name, string(bodyJSON))
+	if nil != err {
+		log.Println("Error setting feature flag " + name)
+		log.Println(err)
+	}
+	return err
+}
+
+type environmentVariableGroupInput struct {
+	Var map[string]interface{} `json:"var"`
+}
+
+//SetEnvironmentVariableGroup updates the running or staging environment variable group,
+//variables set to nil are removed. Values are not logged since they may hold credentials.
+func (api *APIHelper) SetEnvironmentVariableGroup(group string, vars map[string]interface{}) error {
+	bodyJSON, _ := json.Marshal(environmentVariableGroupInput{Var: vars})
+	log.Println("Updating " + group + " environment variable group")
+	_, err := httpRequest(api, "PATCH", "/v3/environment_variable_groups/"+group, string(bodyJSON))
+	if nil != err {
+		log.Println("Error updating " + group + " environment variable group")
+		log.Println(err)
+	}
+	return err
+}
+
 func (api *APIHelper) StartApp(appguid string) (error) {
 	if appguid != "" {
 		log.Println("Starting app (" + appguid + ") with payload: " + "{\"state\":\"STARTED\"}")
@@ -1196,47 +3644,68 @@ func (api *APIHelper) StartApp(appguid string) (error) {
 	return nil
 }
 
-func getServiceInstanceGuid(rservices IServices, name string) (string, error) {
+//Find returns the exported binding to a service instance, a binding without name or parameters when not exported
+func (bindings ServiceBindings) Find(instanceName string) ServiceBinding {
+	for _, binding := range bindings {
+		if binding.InstanceName == instanceName {
+			return binding
+		}
+	}
+	return ServiceBinding{InstanceName: instanceName}
+}
+
+func getServiceInstance(rservices IServices, name string) (ImportedService, error) {
 	for _, service := range rservices {
 		if service.Name == name {
-			return service.Guid, nil
+			return service, nil
 		}
 	}
-	return "", ErrManagedServiceNotFound
+	return ImportedService{}, ErrManagedServiceNotFound
 }
 
 type routeInput struct {
 	DomainGuid string `json:"domain_guid"`
 	SpaceGuid  string `json:"space_guid"`
-	Hostname   string `json:"host"`
+	Hostname   string `json:"host,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Port       int    `json:"port,omitempty"`
 }
 
-func (api *APIHelper) createRoute(domainguid string, spaceguid string, hostname string) (string, error) {
+func (api *APIHelper) createRoute(domainguid string, spaceguid string, route Route) (string, error) {
 	var rguid string
-	query1 := fmt.Sprintf("host:%s", hostname)
-	query2 := fmt.Sprintf("domain_guid:%s", domainguid)
-	path := fmt.Sprintf("/v2/routes?q=%s;q=%s", url.QueryEscape(query1), url.QueryEscape(query2))
-	log.Println("Looking for route: " + hostname + " under domain(" + domainguid + ")")
+	path := "/v2/routes?q=" + url.QueryEscape(fmt.Sprintf("domain_guid:%s", domainguid))
+	path = path + "&q=" + url.QueryEscape(fmt.Sprintf("host:%s", route.Host))
+	path = path + "&q=" + url.QueryEscape(fmt.Sprintf("path:%s", route.Path))
+	if route.Port > 0 {
+		path = path + "&q=" + url.QueryEscape(fmt.Sprintf("port:%d", int(route.Port)))
+	}
+	log.Println("Looking for route: " + routeURL(route) + " under domain(" + domainguid + ")")
 	routeJSON, err := cfcurl.Curl(api.cli, path)
 	if nil == err {
-		total_results := int(routeJSON["total_results"].(float64))
-		if total_results != 0 {
-			routeResource := routeJSON["resources"].([]interface{})[0]
-			theRoute := routeResource.(map[string]interface{})
+		for _, routeIntf := range routeJSON["resources"].([]interface{}) {
+			theRoute := routeIntf.(map[string]interface{})
+			entity := theRoute["entity"].(map[string]interface{})
+			if !routeMatches(entity, route) {
+				continue
+			}
 			metadata := theRoute["metadata"].(map[string]interface{})
 			rguid = metadata["guid"].(string)
-			log.Println("Found existing route with hostname: " + hostname)
-		} else {
+			log.Println("Found existing route: " + routeURL(route))
+			break
+		}
+		if rguid == "" {
 			body := routeInput{
 				DomainGuid: domainguid,
 				SpaceGuid:  spaceguid,
-				Hostname:   hostname,
+				Hostname:   route.Host,
+				Path:       route.Path,
+				Port:       int(route.Port),
 			}
 			bodyJSON, _ := json.Marshal(body)
 			log.Println("Creating route with payload: " + string(bodyJSON))
 			result, err := httpRequest(api, "POST", "/v2/routes", string(bodyJSON))
 			if nil != err {
-				log.Println("Error creating route: " + hostname)
+				log.Println("Error creating route: " + routeURL(route))
 				log.Println(err)
 			}
 			if nil != result {
@@ -1250,9 +3719,63 @@ func (api *APIHelper) createRoute(domainguid string, spaceguid string, hostname
 	return rguid, nil
 }
 
-func (api *APIHelper) bindRoute(routeguid string, appguid string) error {
-	httpRequest(api, "PUT", "/v2/routes/"+routeguid+"/apps/"+appguid, "")
-	return nil
+//routeMatches reports whether a route entity has exactly the host, path and port of the exported route
+func routeMatches(entity map[string]interface{}, route Route) bool {
+	host, _ := entity["host"].(string)
+	path, _ := entity["path"].(string)
+	port, _ := entity["port"].(float64)
+	if host != route.Host || path != route.Path {
+		return false
+	}
+	return route.Port <= 0 || port == route.Port
+}
+
+type sharedDomainInput struct {
+	Name            string `json:"name"`
+	RouterGroupGuid string `json:"router_group_guid"`
+}
+
+//createTCPDomain creates a shared domain on the router group with the given name
+func (api *APIHelper) createTCPDomain(name string, routerGroup string) (string, error) {
+	routerGroupGuid := api.routerGroupGuid(routerGroup)
+	if routerGroupGuid == "" {
+		log.Println("Router group " + routerGroup + " not found for domain " + name)
+		return "", ErrDomainNotFound
+	}
+	body := sharedDomainInput{
+		Name:            name,
+		RouterGroupGuid: routerGroupGuid,
+	}
+	bodyJSON, _ := json.Marshal(body)
+	log.Println("Creating shared domain (" + name + ") with payload: " + string(bodyJSON))
+	result, err := httpRequest(api, "POST", "/v2/shared_domains", string(bodyJSON))
+	if nil != err {
+		log.Println("Error creating shared domain: " + name)
+		return "", err
+	}
+	metadata := result["metadata"].(map[string]interface{})
+	return metadata["guid"].(string), nil
+}
+
+type routeMappingInput struct {
+	AppGuid   string `json:"app_guid"`
+	RouteGuid string `json:"route_guid"`
+	AppPort   int    `json:"app_port,omitempty"`
+}
+
+func (api *APIHelper) mapRoute(routeguid string, appguid string, appport float64) error {
+	body := routeMappingInput{
+		AppGuid:   appguid,
+		RouteGuid: routeguid,
+		AppPort:   int(appport),
+	}
+	bodyJSON, _ := json.Marshal(body)
+	_, err := httpRequest(api, "POST", "/v2/route_mappings", string(bodyJSON))
+	if nil != err {
+		log.Println("Problem mapping route (" + routeguid + ") to app (" + appguid + "): ")
+		log.Println(err)
+	}
+	return err
 }
 
 func httpRequest(api *APIHelper, method string, url string, body string) (map[string]interface{}, error) {
@@ -1381,6 +3904,47 @@ func putSrc(api *APIHelper, url string, filename string) (string, error) {
 
 }
 
+func putBuildpack(api *APIHelper, url string, filename string) (string, error) {
+	if _, err := os.Stat(filename); err == nil {
+		apiendpoint, err := api.cli.ApiEndpoint()
+		check(err)
+		accessToken, err := api.cli.AccessToken()
+		check(err)
+
+		bodyBuf := &bytes.Buffer{}
+		bodyWriter := multipart.NewWriter(bodyBuf)
+
+		// the file name has to end with .zip
+		fileWriter, err := bodyWriter.CreateFormFile("buildpack", filename)
+		check(err)
+		// open file handle
+		fh, err := os.Open(filename)
+		check(err)
+		defer fh.Close()
+
+		//iocopy
+		_, err = io.Copy(fileWriter, fh)
+		check(err)
+		contentType := bodyWriter.FormDataContentType()
+		bodyWriter.Close()
+
+		req, _ := http.NewRequest("PUT", apiendpoint+url, bodyBuf)
+		req.Header.Set("Authorization", accessToken)
+		req.Header.Set("Content-Type", contentType)
+		resp, err := client.Do(req)
+		check(err)
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		check(err)
+		if resp.StatusCode >= 400 {
+			return "Error uploading buildpack " + filename + " (" + resp.Status + ")", fmt.Errorf("upload failed: %v", resp.Status)
+		}
+		return "Uploaded buildpack " + filename + " (" + resp.Status + ")", nil
+	} else {
+		return "Expected buildpack " + filename + " doesn't exist in working directory!", errors.New("buildpack bits not found")
+	}
+}
+
 func check(e error) {
 	if e != nil {
 		log.Fatal(e)
@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/cloudfoundry/cli/plugin"
 	"github.com/jigsheth57/clone-apps-plugin/apihelper"
@@ -18,10 +20,18 @@ type CloneAppsCmd struct {
 
 // contains CLI flag values
 type flagVal struct {
-	OrgName 		string
-	Download 		string
-	Domain			string
-	RestoreState	string
+	OrgName 				string
+	Download 				string
+	Domain					string
+	RestoreState			string
+	UpdateSecurityGroups	string
+	UserMappingFile			string
+	ServiceOverridesFile	string
+	BrokerPasswordsFile		string
+	VolumeSecretsFile		string
+	ServiceTimeout			string
+	PlatformConfig			string
+	Buildpacks				string
 }
 
 func ParseFlags(args []string) flagVal {
@@ -32,6 +42,14 @@ func ParseFlags(args []string) flagVal {
 	bits := flagSet.String("d", "", "-d download")
 	domain := flagSet.String("ad", "", "-ad addtional_share_domain")
 	restore_state := flagSet.String("s", "", "-s restore_state")
+	update_security_groups := flagSet.String("usg", "", "-usg update_security_groups")
+	user_mapping_file := flagSet.String("um", "", "-um user_mapping_file")
+	service_overrides_file := flagSet.String("so", "", "-so service_overrides_file")
+	broker_passwords_file := flagSet.String("sbp", "", "-sbp service_broker_passwords_file")
+	volume_secrets_file := flagSet.String("vs", "", "-vs volume_secrets_file")
+	service_timeout := flagSet.String("st", "", "-st service_timeout_seconds")
+	platform_config := flagSet.String("pc", "", "-pc platform_config")
+	buildpacks := flagSet.String("bp", "", "-bp buildpacks")
 
 	err := flagSet.Parse(args[1:])
 	if err != nil {
@@ -43,6 +61,14 @@ func ParseFlags(args []string) flagVal {
 		Download:  string(*bits),
 		Domain: string(*domain),
 		RestoreState: string(*restore_state),
+		UpdateSecurityGroups: string(*update_security_groups),
+		UserMappingFile: string(*user_mapping_file),
+		ServiceOverridesFile: string(*service_overrides_file),
+		BrokerPasswordsFile: string(*broker_passwords_file),
+		VolumeSecretsFile: string(*volume_secrets_file),
+		ServiceTimeout: string(*service_timeout),
+		PlatformConfig: string(*platform_config),
+		Buildpacks: string(*buildpacks),
 	}
 }
 
@@ -60,10 +86,11 @@ func (cmd *CloneAppsCmd) GetMetadata() plugin.PluginMetadata {
 				Name:     "export-apps",
 				HelpText: "Export apps metadata (including service instances info), droplets & src code",
 				UsageDetails: plugin.Usage{
-					Usage: "cf export-apps [-o orgName] [-d download]",
+					Usage: "cf export-apps [-o orgName] [-d download] [-bp true]",
 					Options: map[string]string{
 						"o": "organization",
 						"d": "download",
+						"bp": "Export and download admin buildpacks (true/false)",
 					},
 				},
 			},
@@ -71,11 +98,19 @@ func (cmd *CloneAppsCmd) GetMetadata() plugin.PluginMetadata {
 				Name:     "import-apps",
 				HelpText: "Import apps metadata (including service instances info), droplets & src code",
 				UsageDetails: plugin.Usage{
-					Usage: "cf import-apps [-o orgName] [-ad addtional_share_domain] [-s true]",
+					Usage: "cf import-apps [-o orgName] [-ad addtional_share_domain] [-s true] [-usg true] [-um user_mapping_file] [-so service_overrides_file] [-sbp service_broker_passwords_file] [-vs volume_secrets_file] [-st 600] [-pc true|only] [-bp true]",
 					Options: map[string]string{
 						"o": "organization",
 						"ad": "Addtional domain",
 						"s": "Restore app state (true/false)",
+						"usg": "Update existing security groups with differing rules (true/false)",
+						"um": "JSON file mapping source usernames to target users",
+						"so": "JSON file with service instance parameters keyed by org/space/instance",
+						"sbp": "JSON file with space scoped service broker passwords keyed by org/space/broker",
+						"vs": "JSON file with volume service bind secrets keyed by org/space/app/instance",
+						"st": "Seconds to wait for asynchronous service provisioning, from the first instance still provisioning (default 600)",
+						"pc": "Apply the exported feature flags, environment variable groups and default security groups along with the orgs (true), without importing any org (only) or not at all (false)",
+						"bp": "Create and upload the exported admin buildpacks missing on the target (true/false)",
 					},
 				},
 			},
@@ -107,10 +142,23 @@ func (cmd *CloneAppsCmd) ExportAppsCmd(args []string) {
 		}
 	}
 
+	cmd.addNetworkPolicies(orgs)
+	export_buildpacks := false
+	if b, err := strconv.ParseBool(flagVals.Buildpacks); err == nil {
+		export_buildpacks = b
+	}
+	var platformConfig *models.PlatformConfig
+	if flagVals.OrgName == "" || export_buildpacks {
+		platformConfig = cmd.getPlatformConfig(export_buildpacks)
+	}
+
 	if flagVals.Download == "download" {
-		fmt.Println(orgs.ExportMetaAndBits(cmd.apiHelper))
+		fmt.Println(orgs.ExportMetaAndBits(cmd.apiHelper, platformConfig))
 	} else {
-		fmt.Println(orgs.ExportMetaOnly())
+		fmt.Println(orgs.ExportMetaOnly(platformConfig))
+	}
+	if nil != platformConfig && export_buildpacks {
+		fmt.Println(platformConfig.ExportBuildpacks(cmd.apiHelper))
 	}
 }
 
@@ -120,8 +168,136 @@ func (cmd *CloneAppsCmd) ImportAppsCmd(args []string) {
 	if s, err := strconv.ParseBool(flagVals.RestoreState); err == nil {
 		restore_state = s
 	}
+	update_security_groups := false
+	if u, err := strconv.ParseBool(flagVals.UpdateSecurityGroups); err == nil {
+		update_security_groups = u
+	}
+	platform_config := false
+	platform_config_only := flagVals.PlatformConfig == "only"
+	if p, err := strconv.ParseBool(flagVals.PlatformConfig); err == nil {
+		platform_config = p
+	}
+	if platform_config_only {
+		platform_config = true
+	}
+	import_buildpacks := false
+	if b, err := strconv.ParseBool(flagVals.Buildpacks); err == nil {
+		import_buildpacks = b
+	}
+	service_timeout := 600
+	if t, err := strconv.Atoi(flagVals.ServiceTimeout); err == nil {
+		service_timeout = t
+	}
 	fmt.Println(models.ImportMetaAndBits(cmd.apiHelper,models.ImportFlags{OrgName:flagVals.OrgName,
-		Domain:flagVals.Domain, RestoreState:restore_state}))
+		Domain:flagVals.Domain, RestoreState:restore_state, UpdateSecurityGroups:update_security_groups,
+		UserMappingFile:flagVals.UserMappingFile, ServiceOverridesFile:flagVals.ServiceOverridesFile,
+		BrokerPasswordsFile:flagVals.BrokerPasswordsFile, VolumeSecretsFile:flagVals.VolumeSecretsFile,
+		ServiceTimeout:time.Duration(service_timeout) * time.Second,
+		DockerPassword:os.Getenv("CF_DOCKER_PASSWORD"), PlatformConfig:platform_config,
+		PlatformConfigOnly:platform_config_only, Buildpacks:import_buildpacks}))
+}
+
+//getPlatformConfig returns the feature flags, environment variable groups, default security groups and optionally
+//the admin buildpacks, or nil when not run as admin
+func (cmd *CloneAppsCmd) getPlatformConfig(buildpacks bool) *models.PlatformConfig {
+	if !cmd.apiHelper.IsAdmin() {
+		fmt.Println("Not logged in as admin, platform configuration not exported.")
+		return nil
+	}
+	rawConfig, err := cmd.apiHelper.GetPlatformConfig()
+	if nil != err {
+		fmt.Println("Unable to export platform configuration: ", err)
+		return nil
+	}
+	config := &models.PlatformConfig{
+		FeatureFlags:                rawConfig.FeatureFlags,
+		RunningEnvironmentVariables: rawConfig.RunningEnvironmentVariables,
+		StagingEnvironmentVariables: rawConfig.StagingEnvironmentVariables,
+	}
+	rawSecurityGroups, err := cmd.apiHelper.GetSecurityGroups()
+	if nil != err {
+		fmt.Println("Unable to export default security groups: ", err)
+	}
+	for _, sg := range rawSecurityGroups {
+		if !sg.RunningDefault && !sg.StagingDefault {
+			continue
+		}
+		rules := []models.Rule{}
+		for _, r := range sg.Rules {
+			rules = append(rules, models.Rule{
+				Description: r.Description,
+				Destination: r.Destination,
+				Log:         r.Log,
+				Ports:       r.Ports,
+				Protocol:    r.Protocol,
+			})
+		}
+		config.SecurityGroups = append(config.SecurityGroups, models.SecurityGroup{
+			Name:           sg.Name,
+			Rules:          rules,
+			RunningDefault: sg.RunningDefault,
+			StagingDefault: sg.StagingDefault,
+		})
+	}
+	// sorted by name so the order in apps.json is stable between exports
+	sort.Slice(config.SecurityGroups, func(i, j int) bool {
+		return config.SecurityGroups[i].Name < config.SecurityGroups[j].Name
+	})
+	if buildpacks {
+		rawBuildpacks, err := cmd.apiHelper.GetBuildpacks()
+		if nil != err {
+			fmt.Println("Unable to export admin buildpacks: ", err)
+			return config
+		}
+		for _, b := range rawBuildpacks {
+			config.Buildpacks = append(config.Buildpacks, models.Buildpack{
+				Guid:     b.Guid,
+				Name:     b.Name,
+				Position: b.Position,
+				Stack:    b.Stack,
+				Enabled:  b.Enabled,
+				Locked:   b.Locked,
+				Filename: b.Filename,
+			})
+		}
+	}
+	return config
+}
+
+//addNetworkPolicies records on each source space the network policies whose source and destination apps are both exported
+func (cmd *CloneAppsCmd) addNetworkPolicies(orgs models.Orgs) {
+	rawPolicies, err := cmd.apiHelper.GetNetworkPolicies()
+	if nil != err {
+		fmt.Println("Unable to export network policies: ", err)
+		return
+	}
+	type appLocation struct {
+		org, space int
+		ref        models.AppRef
+	}
+	apps := make(map[string]appLocation)
+	for o, org := range orgs {
+		for s, space := range org.Spaces {
+			for _, app := range space.Apps {
+				apps[app.Guid] = appLocation{o, s, models.AppRef{Org: org.Name, Space: space.Name, App: app.Name}}
+			}
+		}
+	}
+	for _, p := range rawPolicies {
+		source, sourceFound := apps[p.SourceGuid]
+		destination, destinationFound := apps[p.DestinationGuid]
+		if !sourceFound || !destinationFound {
+			continue
+		}
+		space := &orgs[source.org].Spaces[source.space]
+		space.NetworkPolicies = append(space.NetworkPolicies, models.NetworkPolicy{
+			Source:      source.ref,
+			Destination: destination.ref,
+			Protocol:    p.Protocol,
+			StartPort:   p.StartPort,
+			EndPort:     p.EndPort,
+		})
+	}
 }
 
 func (cmd *CloneAppsCmd) getOrgQuota() (models.Quotas, error) {
@@ -184,18 +360,46 @@ func (cmd *CloneAppsCmd) getOrgDetails(o apihelper.Organization, quotas models.Q
 	if q, found := quotas[o.QuotaGUID]; found {
 		quota = q
 	}
-	spaces, err := cmd.getSpaces(o.SpacesURL)
+	roles, err := cmd.getRoles(cmd.apiHelper.GetOrgRoles(o.Guid))
+	if nil != err {
+		return models.Org{}, err
+	}
+	privateDomains, err := cmd.getPrivateDomains(o.Guid)
+	if nil != err {
+		return models.Org{}, err
+	}
+	isolationSegments, defaultIsolationSegment, err := cmd.apiHelper.GetOrgIsolationSegments(o.Guid)
+	if nil != err {
+		return models.Org{}, err
+	}
+	planVisibilities, err := cmd.getPlanVisibilities(o.Guid)
+	if nil != err {
+		return models.Org{}, err
+	}
+	spaceQuotas, err := cmd.apiHelper.GetSpaceQuotas(o.Guid)
+	if nil != err {
+		return models.Org{}, err
+	}
+	spaces, err := cmd.getSpaces(o.SpacesURL, spaceQuotas)
 	if nil != err {
 		return models.Org{}, err
 	}
 	return models.Org{
+		Guid:       o.Guid,
 		Name:       o.Name,
+		Foundation: o.Foundation,
+		Metadata:   toMetadata(o.Metadata),
 		Quota: 		quota,
+		Roles:		roles,
+		PrivateDomains: privateDomains,
+		IsolationSegments: isolationSegments,
+		DefaultIsolationSegment: defaultIsolationSegment,
+		PlanVisibilities: planVisibilities,
 		Spaces:     spaces,
 	}, nil
 }
 
-func (cmd *CloneAppsCmd) getSpaces(spaceURL string) ([]models.Space, error) {
+func (cmd *CloneAppsCmd) getSpaces(spaceURL string, spaceQuotas apihelper.SpaceQuotas) ([]models.Space, error) {
 	rawSpaces, err := cmd.apiHelper.GetOrgSpaces(spaceURL)
 	if nil != err {
 		return nil, err
@@ -206,19 +410,124 @@ func (cmd *CloneAppsCmd) getSpaces(spaceURL string) ([]models.Space, error) {
 		if nil != err {
 			return nil, err
 		}
+		roles, err := cmd.getRoles(cmd.apiHelper.GetSpaceRoles(s.Guid))
+		if nil != err {
+			return nil, err
+		}
+		isolationSegment, err := cmd.apiHelper.GetSpaceIsolationSegment(s.Guid)
+		if nil != err {
+			return nil, err
+		}
+		allowSsh := s.AllowSsh
+		serviceBrokers, err := cmd.getServiceBrokers(s.Guid)
+		if nil != err {
+			return nil, err
+		}
+		var spaceQuota = models.SpaceQuota{}
+		if q, found := spaceQuotas[s.SpaceQuotaGUID]; found {
+			spaceQuota = models.SpaceQuota{
+				Name:						q.Name,
+				NonBasicServicesAllowed:	q.NonBasicServicesAllowed,
+				TotalServices:				q.TotalServices,
+				TotalRoutes:				q.TotalRoutes,
+				MemoryLimit:				q.MemoryLimit,
+				InstanceMemoryLimit:		q.InstanceMemoryLimit,
+				AppInstanceLimit:			q.AppInstanceLimit,
+				AppTaskLimit:				q.AppTaskLimit,
+				TotalServiceKeys:			q.TotalServiceKeys,
+				TotalReservedRoutePorts:	q.TotalReservedRoutePorts,
+			}
+		}
 		spaces = append(spaces,
 			models.Space{
+				Guid: s.Guid,
 				Name: s.Name,
+				Metadata: toMetadata(s.Metadata),
 				Apps: apps,
 				Services: services,
 				SecurityGroup: securityGroups,
 				StagingSecurityGroup: stagingSecurityGroups,
+				SpaceQuota: spaceQuota,
+				Roles: roles,
+				IsolationSegment: isolationSegment,
+				ServiceBrokers: serviceBrokers,
+				AllowSsh: &allowSsh,
 			},
 		)
 	}
 	return spaces, nil
 }
 
+func (cmd *CloneAppsCmd) getServiceBrokers(spaceguid string) ([]models.ServiceBroker, error) {
+	rawBrokers, err := cmd.apiHelper.GetSpaceServiceBrokers(spaceguid)
+	if nil != err {
+		return nil, err
+	}
+	var brokers = []models.ServiceBroker{}
+	for _, b := range rawBrokers {
+		brokers = append(brokers, models.ServiceBroker{
+			Name:     b.Name,
+			URL:      b.URL,
+			Username: b.Username,
+		})
+	}
+	return brokers, nil
+}
+
+//getPlanVisibilities returns the org's service plan visibilities, which only an admin can read
+func (cmd *CloneAppsCmd) getPlanVisibilities(orgguid string) ([]models.PlanVisibility, error) {
+	var visibilities = []models.PlanVisibility{}
+	rawVisibilities, err := cmd.apiHelper.GetOrgPlanVisibilities(orgguid)
+	if nil != err {
+		fmt.Println("Unable to export service plan visibilities: ", err)
+		return visibilities, nil
+	}
+	for _, v := range rawVisibilities {
+		visibilities = append(visibilities, models.PlanVisibility{
+			Service: v.Service,
+			Plan:    v.Plan,
+		})
+	}
+	return visibilities, nil
+}
+
+func (cmd *CloneAppsCmd) getPrivateDomains(orgguid string) ([]models.PrivateDomain, error) {
+	rawDomains, err := cmd.apiHelper.GetOrgPrivateDomains(orgguid)
+	if nil != err {
+		return nil, err
+	}
+	var domains = []models.PrivateDomain{}
+	for _, d := range rawDomains {
+		domains = append(domains, models.PrivateDomain{
+			Name:               d.Name,
+			OwningOrganization: d.OwningOrganization,
+		})
+	}
+	return domains, nil
+}
+
+func (cmd *CloneAppsCmd) getRoles(rawRoles apihelper.Roles, err error) ([]models.Role, error) {
+	if nil != err {
+		return nil, err
+	}
+	var roles = []models.Role{}
+	for _, r := range rawRoles {
+		roles = append(roles, models.Role{
+			Type:     r.Type,
+			Username: r.Username,
+			Origin:   r.Origin,
+		})
+	}
+	return roles, nil
+}
+
+func toMetadata(m apihelper.Metadata) models.Metadata {
+	return models.Metadata{
+		Labels:      m.Labels,
+		Annotations: m.Annotations,
+	}
+}
+
 func (cmd *CloneAppsCmd) getAppsAndServices(space apihelper.Space) ([]models.App, []models.Service, []models.SecurityGroup, []models.SecurityGroup, error) {
 	rawApps, rawServices, rawSecurityGroups, rawStagingSecurityGroups, err := cmd.apiHelper.GetSpaceAppsAndServices(space)
 	if nil != err {
@@ -229,6 +538,57 @@ func (cmd *CloneAppsCmd) getAppsAndServices(space apihelper.Space) ([]models.App
 	var securityGroups = []models.SecurityGroup{}
 	var stagingSecurityGroups = []models.SecurityGroup{}
 	for _, a := range rawApps {
+		routes := []models.Route{}
+		for _, r := range a.Routes {
+			routes = append(routes, models.Route{
+				Host:        r.Host,
+				Domain:      r.Domain,
+				Path:        r.Path,
+				Port:        r.Port,
+				AppPort:     r.AppPort,
+				RouterGroup: r.RouterGroup,
+			})
+		}
+		processes := []models.Process{}
+		for _, p := range a.Processes {
+			processes = append(processes, models.Process{
+				Type:                         p.Type,
+				Command:                      p.Command,
+				Instances:                    p.Instances,
+				Memory:                       p.Memory,
+				DiskQuota:                    p.DiskQuota,
+				HealthCheckType:              p.HealthCheckType,
+				HealthCheckTimeout:           p.HealthCheckTimeout,
+				HealthCheckInvocationTimeout: p.HealthCheckInvocationTimeout,
+				HealthCheckHttpEndpoint:      p.HealthCheckHttpEndpoint,
+			})
+		}
+		sidecars := []models.Sidecar{}
+		for _, sc := range a.Sidecars {
+			sidecars = append(sidecars, models.Sidecar{
+				Name:         sc.Name,
+				Command:      sc.Command,
+				ProcessTypes: sc.ProcessTypes,
+				Memory:       sc.Memory,
+			})
+		}
+		bindings := []models.ServiceBinding{}
+		for _, b := range a.ServiceBindings {
+			volumeMounts := models.VolumeMounts{}
+			for _, m := range b.VolumeMounts {
+				volumeMounts = append(volumeMounts, models.VolumeMount{
+					ContainerDir: m.ContainerDir,
+					Mode:         m.Mode,
+					DeviceType:   m.DeviceType,
+				})
+			}
+			bindings = append(bindings, models.ServiceBinding{
+				InstanceName: b.InstanceName,
+				Name:         b.Name,
+				Parameters:   b.Parameters,
+				VolumeMounts: volumeMounts,
+			})
+		}
 		endpoint := a.HealthCheckHttpEndpoint
 		if (a.HealthCheckType == "http" && endpoint == "") {
 			endpoint = "/"
@@ -248,17 +608,57 @@ func (cmd *CloneAppsCmd) getAppsAndServices(space apihelper.Space) ([]models.App
 			EnableSsh:a.EnableSsh,
 			EnviornmentVar:a.EnviornmentVar,
 			ServiceNames:a.ServiceNames,
-			URLs:a.URLs,
+			Ports:a.Ports,
+			Routes:routes,
+			Buildpacks:a.Buildpacks,
+			DetectedBuildpack:a.DetectedBuildpack,
+			BuildpackVersion:a.BuildpackVersion,
+			Stack:a.Stack,
+			DockerImage:a.DockerImage,
+			DockerUsername:a.DockerUsername,
+			Processes:processes,
+			Sidecars:sidecars,
+			Metadata:toMetadata(a.Metadata),
+			ServiceBindings:bindings,
 		})
 	}
 	for _, s := range rawServices {
+		routes := []models.Route{}
+		for _, r := range s.Routes {
+			routes = append(routes, models.Route{
+				Host:   r.Host,
+				Domain: r.Domain,
+				Path:   r.Path,
+				Port:   r.Port,
+			})
+		}
+		sharedTo := []models.SpaceRef{}
+		for _, t := range s.SharedTo {
+			sharedTo = append(sharedTo, models.SpaceRef{Org: t.Org, Space: t.Space})
+		}
+		serviceKeys := []models.ServiceKey{}
+		for _, k := range s.ServiceKeys {
+			serviceKeys = append(serviceKeys, models.ServiceKey{
+				Name:       k.Name,
+				Parameters: k.Parameters,
+			})
+		}
 		services = append(services, models.Service{
+			Guid: s.Guid,
 			InstanceName: s.InstanceName,
 			Label: s.Label,
 			ServicePlan: s.ServicePlan,
 			Type:s.Type,
 			Credentials:s.Credentials,
 			SyslogDrain:s.SyslogDrain,
+			RouteServiceURL:s.RouteServiceURL,
+			Routes:routes,
+			Tags:s.Tags,
+			Parameters:s.Parameters,
+			ServiceKeys:serviceKeys,
+			Metadata:toMetadata(s.Metadata),
+			SharedFrom:models.SpaceRef{Org: s.SharedFrom.Org, Space: s.SharedFrom.Space},
+			SharedTo:sharedTo,
 		})
 	}
 	for _, sg := range rawSecurityGroups {
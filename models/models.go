@@ -1,12 +1,15 @@
 package models
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,17 +18,33 @@ import (
 )
 
 type Org struct {
+	Guid        string
 	Name        string
+	Foundation  string
+	Metadata    Metadata
 	Quota		Quota
+	Roles		Roles
+	PrivateDomains	PrivateDomains
+	IsolationSegments		[]string
+	DefaultIsolationSegment	string
+	PlanVisibilities		PlanVisibilities
 	Spaces      Spaces
 }
 
 type Space struct {
+	Guid					string
 	Name     				string
+	Metadata				Metadata
 	Apps     				Apps
 	Services 				Services
 	SecurityGroup			SecurityGroups
 	StagingSecurityGroup	SecurityGroups
+	SpaceQuota				SpaceQuota
+	Roles					Roles
+	NetworkPolicies			NetworkPolicies
+	IsolationSegment		string
+	ServiceBrokers			ServiceBrokers
+	AllowSsh				*bool
 }
 
 //App representation
@@ -44,17 +63,100 @@ type App struct {
 	EnableSsh               bool
 	EnviornmentVar          map[string]interface{}
 	ServiceNames            []interface{}
-	URLs                    []interface{}
+	Ports                   []float64
+	Routes                  Routes
+	Buildpacks              []string
+	DetectedBuildpack       string
+	BuildpackVersion        string
+	Stack                   string
+	DockerImage             string
+	DockerUsername          string
+	Processes               Processes
+	Sidecars                Sidecars
+	Metadata                Metadata
+	ServiceBindings         ServiceBindings
+}
+
+//ServiceBinding representation of the binding of an app to a service instance, Name is empty for unnamed bindings
+type ServiceBinding struct {
+	InstanceName string
+	Name         string
+	Parameters   map[string]interface{}
+	VolumeMounts VolumeMounts
+}
+
+//VolumeMount representation of a volume service mount, Mode is "r" or "rw"
+type VolumeMount struct {
+	ContainerDir string
+	Mode         string
+	DeviceType   string
+}
+
+//Metadata representation of v3 labels and annotations
+type Metadata struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+//Sidecar representation, Memory 0 means the sidecar shares the process memory
+type Sidecar struct {
+	Name         string
+	Command      string
+	ProcessTypes []string
+	Memory       float64
+}
+
+//Process representation of a v3 app process type
+type Process struct {
+	Type                         string
+	Command                      string
+	Instances                    float64
+	Memory                       float64
+	DiskQuota                    float64
+	HealthCheckType              string
+	HealthCheckTimeout           float64
+	HealthCheckInvocationTimeout float64
+	HealthCheckHttpEndpoint      string
+}
+
+//Route representation, Port is only set for TCP routes and AppPort 0 means the app's default port
+type Route struct {
+	Host        string
+	Domain      string
+	Path        string
+	Port        float64
+	AppPort     float64
+	RouterGroup string
 }
 
 //Service representation
 type Service struct {
-	InstanceName string
-	Label        string
-	ServicePlan  string
-	Type         string
-	Credentials  map[string]interface{}
-	SyslogDrain  string
+	Guid            string
+	InstanceName    string
+	Label           string
+	ServicePlan     string
+	Type            string
+	Credentials     map[string]interface{}
+	SyslogDrain     string
+	RouteServiceURL string
+	Routes          Routes
+	Tags            []string
+	Parameters      map[string]interface{}
+	ServiceKeys     ServiceKeys
+	Metadata        Metadata
+	SharedFrom      SpaceRef
+	SharedTo        []SpaceRef
+}
+
+//SpaceRef identifies a space by org and space name, SharedFrom is empty for an instance owned by the space
+type SpaceRef struct {
+	Org   string
+	Space string
+}
+
+type ServiceKey struct {
+	Name       string
+	Parameters map[string]interface{}
 }
 
 type Quota struct {
@@ -72,6 +174,67 @@ type Quota struct {
 	TotalReservedRoutePorts	float64
 }
 
+type SpaceQuota struct {
+	Name 					string
+	NonBasicServicesAllowed	bool
+	TotalServices			float64
+	TotalRoutes				float64
+	MemoryLimit				float64
+	InstanceMemoryLimit		float64
+	AppInstanceLimit		float64
+	AppTaskLimit			float64
+	TotalServiceKeys		float64
+	TotalReservedRoutePorts	float64
+}
+
+//AppRef identifies an app across foundations by org, space and app name
+type AppRef struct {
+	Org		string
+	Space	string
+	App		string
+}
+
+//NetworkPolicy representation, recorded on the space of the source app
+type NetworkPolicy struct {
+	Source		AppRef
+	Destination	AppRef
+	Protocol	string
+	StartPort	float64
+	EndPort		float64
+}
+
+//ServiceBroker representation of a space scoped broker, the password is supplied at import
+type ServiceBroker struct {
+	Name     string
+	URL      string
+	Username string
+}
+
+//PlanVisibility representation of a service plan made visible to an org, Service is the service label
+type PlanVisibility struct {
+	Service string
+	Plan    string
+}
+
+//PrivateDomain representation, OwningOrganization is the name of the org owning the domain
+type PrivateDomain struct {
+	Name				string
+	OwningOrganization	string
+}
+
+//Role representation, a user is identified by username and origin
+type Role struct {
+	Type		string
+	Username	string
+	Origin		string
+}
+
+//UserMapping maps a source foundation username to the user on the target foundation
+type UserMapping struct {
+	Username	string
+	Origin		string
+}
+
 type SecurityGroup	struct {
 	Name			string
 	Rules			Rules
@@ -87,25 +250,75 @@ type Rule struct {
 	Protocol		string
 }
 
+//PlatformConfig is the foundation wide configuration, only exported when run as admin
+type PlatformConfig struct {
+	FeatureFlags                map[string]bool
+	RunningEnvironmentVariables map[string]interface{}
+	StagingEnvironmentVariables map[string]interface{}
+	Buildpacks                  Buildpacks
+	SecurityGroups              SecurityGroups
+}
+
+//Buildpack representation of an admin buildpack, Filename is empty when no bits were uploaded
+type Buildpack struct {
+	Guid     string
+	Name     string
+	Position float64
+	Stack    string
+	Enabled  bool
+	Locked   bool
+	Filename string
+}
+
+//Export is the layout of apps.json when the platform configuration is exported,
+//otherwise apps.json only holds the list of orgs
+type Export struct {
+	PlatformConfig *PlatformConfig
+	Orgs           Orgs
+}
+
 type Orgs []Org
+type Buildpacks []Buildpack
 type Quotas map[string]Quota
+type NetworkPolicies []NetworkPolicy
+type PrivateDomains []PrivateDomain
+type Roles []Role
+type Processes []Process
+type Sidecars []Sidecar
+type ServiceBindings []ServiceBinding
+type VolumeMounts []VolumeMount
+type VolumeSecrets map[string]map[string]interface{}
+type Routes []Route
+type ServiceKeys []ServiceKey
 type Rules	[]Rule
+type UserMappings map[string]UserMapping
+type ServiceOverrides map[string]map[string]interface{}
+type BrokerPasswords map[string]string
+type ServiceBrokers []ServiceBroker
+type PlanVisibilities []PlanVisibility
 type SecurityGroups	[]SecurityGroup
 type Spaces []Space
 type Apps []App
 type Services []Service
 
 type ImportedOrg struct {
-	Guid   string
-	Name   string
-	Spaces ISpaces
+	Guid          string
+	Name          string
+	Quota         ImportedQuota
+	QuotaWarnings []string
+	MissingUsers   []string
+	PrivateDomains IDomains
+	Spaces         ISpaces
 }
 
 type ImportedSpace struct {
-	Guid     string
-	Name     string
-	Apps     IApps
-	Services IServices
+	Guid           string
+	Name           string
+	SpaceQuota     ImportedQuota
+	Apps           IApps
+	Services       IServices
+	SecurityGroups ISecurityGroups
+	ServiceBrokers IServiceBrokers
 }
 
 type ImportedApp struct {
@@ -114,31 +327,112 @@ type ImportedApp struct {
 	Droplet 		string
 	Src     		string
 	OrgState		string
+	Docker			bool
+	Startable		bool
+	BlockedBy		[]string
+	SkippedProcesses	[]string
 }
 
 type ImportedService struct {
-	Guid string
-	Name string
+	Guid  string
+	Name  string
+	State string
+}
+
+type ImportedQuota struct {
+	Guid   string
+	Name   string
+	Action string
+}
+
+//ImportedServiceKey is reported in service_keys.json so consumers of the keys can be reconfigured
+type ImportedServiceKey struct {
+	Org             string
+	Space           string
+	ServiceInstance string
+	Name            string
+	Credentials     map[string]interface{}
+}
+
+type ImportedDomain struct {
+	Guid   string
+	Name   string
+	Action string
+}
+
+type ImportedServiceBroker struct {
+	Guid   string
+	Name   string
+	Action string
+}
+
+type ImportedSecurityGroup struct {
+	Guid      string
+	Name      string
+	Action    string
+	Lifecycle string
 }
 
 type ImportFlags struct {
-	OrgName 		string
-	Domain			string
-	RestoreState	bool
+	OrgName 				string
+	Domain					string
+	RestoreState			bool
+	UpdateSecurityGroups	bool
+	UserMappingFile			string
+	ServiceOverridesFile	string
+	BrokerPasswordsFile		string
+	VolumeSecretsFile		string
+	ServiceTimeout			time.Duration
+	DockerPassword			string
+	PlatformConfig			bool
+	PlatformConfigOnly		bool
+	Buildpacks				bool
+}
+
+//dropletTimeout bounds the wait for the uploaded droplets to be processed before the app processes are scaled
+const dropletTimeout = 10 * time.Minute
+
+//deferredBinding is a binding postponed until its service instance has finished provisioning
+type deferredBinding struct {
+	AppGuid      string
+	SpaceGuid    string
+	InstanceName string
+	ServiceGuid  string
+	Binding      apihelper.ServiceBinding
+}
+
+//sharedInstance is a service instance to share into a space from the space owning it
+type sharedInstance struct {
+	Owner     SpaceRef
+	Service   Service
+	Space     string
+	SpaceGuid string
 }
 
+//deferredServiceKeys are service keys postponed until their service instance has finished provisioning
+type deferredServiceKeys struct {
+	Org         string
+	Space       string
+	Service     Service
+	ServiceGuid string
+}
+
+type IDomains []ImportedDomain
+type IServiceKeys []ImportedServiceKey
+type ISecurityGroups []ImportedSecurityGroup
+type IServiceBrokers []ImportedServiceBroker
 type IServices []ImportedService
 type IApps []ImportedApp
 type ISpaces []ImportedSpace
 type IOrgs []ImportedOrg
 
-func (orgs *Orgs) ExportMetaOnly() string {
-	writeToJson(*orgs)
+func (orgs *Orgs) ExportMetaOnly(platformConfig *PlatformConfig) string {
+	writeToJson(*orgs, platformConfig)
 	return "Succefully exported apps metadata to apps.json file."
 }
 
-func (orgs *Orgs) ExportMetaAndBits(apiHelper apihelper.CFAPIHelper) string {
-	writeToJson(*orgs)
+func (orgs *Orgs) ExportMetaAndBits(apiHelper apihelper.CFAPIHelper, platformConfig *PlatformConfig) string {
+	writeToJson(*orgs, platformConfig)
 	//chBits := make(chan string, 2)
 	rand.Seed(time.Now().UnixNano())
 	// Typical use-case:
@@ -151,9 +445,13 @@ func (orgs *Orgs) ExportMetaAndBits(apiHelper apihelper.CFAPIHelper) string {
 	i := 0
 	for _, org := range *orgs {
 		for _, space := range org.Spaces {
-			i += len(space.Apps) * 2
 			//download := (space.Name == "jigsheth")
 			for _, app := range space.Apps {
+				if app.DockerImage != "" {
+					log.Println("Skipping bits of Docker app " + org.Name + "/" + space.Name + "/" + app.Name)
+					continue
+				}
+				i += 2
 				//if(download) {
 				droplet_swg.Add()
 				go apiHelper.GetBlob(org.Name,space.Name,"/v2/apps/"+app.Guid+"/droplet/download", url.PathEscape(app.Name)+"_"+app.Guid+".droplet", &droplet_swg)
@@ -179,71 +477,316 @@ func (orgs *Orgs) ExportMetaAndBits(apiHelper apihelper.CFAPIHelper) string {
 	return "Succefully exported apps metadata to apps.json file and downloaded all bits."
 }
 
+//ExportBuildpacks downloads the bits of the exported admin buildpacks
+func (config *PlatformConfig) ExportBuildpacks(apiHelper apihelper.CFAPIHelper) string {
+	swg := sizedwaitgroup.New(5)
+	i := 0
+	for _, buildpack := range config.Buildpacks {
+		if buildpack.Filename == "" {
+			log.Println("Buildpack " + buildpack.Name + " has no bits, skipping download")
+			continue
+		}
+		i++
+		swg.Add()
+		go apiHelper.GetBlob("admin", "buildpacks", "/v2/buildpacks/"+buildpack.Guid+"/download", buildpackFile(buildpack), &swg)
+	}
+	log.Println("Number of buildpacks to download ", i)
+	swg.Wait()
+	return "Succefully downloaded admin buildpacks."
+}
+
+func buildpackFile(buildpack Buildpack) string {
+	return url.PathEscape(buildpack.Name) + "_" + buildpack.Guid + ".zip"
+}
+
 func ImportMetaAndBits(apiHelper apihelper.CFAPIHelper, importFlags ImportFlags) string {
-	orgs := readToJson()
+	// the wait for asynchronous service instances starts with the first one still provisioning
+	var deadline time.Time
+	orgs, platformConfig := readToJson()
+	if importFlags.PlatformConfigOnly {
+		importPlatform(apiHelper, platformConfig, importFlags)
+		return "Succefully applied the platform configuration from apps.json file."
+	}
 	var iorgs IOrgs
+	var iservicekeys IServiceKeys
+	var deferredBindings []deferredBinding
+	var deferredKeys []deferredServiceKeys
+	var sharedInstances []sharedInstance
+	ownedInstances := make(map[string]string)
+	appProcesses := make(map[string]Processes)
 	filterOrg := importFlags.OrgName != ""
+	importing := make(map[string]bool)
+	// orgs created early as owners of private domains shared with an org imported before them
+	createdOrgs := make(map[string]apihelper.ImportedOrg)
+	for _, org := range orgs {
+		if !filterOrg || importFlags.OrgName == org.Name {
+			importing[org.Name] = true
+		}
+	}
 	addRoute := importFlags.Domain != ""
+	importedSecurityGroups := make(map[string]apihelper.ImportedSecurityGroup)
+	userMappings := UserMappings{}
+	if importFlags.UserMappingFile != "" {
+		userMappings = readUserMappings(importFlags.UserMappingFile)
+	}
+	serviceOverrides := ServiceOverrides{}
+	if importFlags.ServiceOverridesFile != "" {
+		serviceOverrides = readServiceOverrides(importFlags.ServiceOverridesFile)
+	}
+	volumeSecrets := VolumeSecrets{}
+	if importFlags.VolumeSecretsFile != "" {
+		volumeSecrets = readVolumeSecrets(importFlags.VolumeSecretsFile)
+	}
+	brokerPasswords := BrokerPasswords{}
+	if importFlags.BrokerPasswordsFile != "" {
+		brokerPasswords = readBrokerPasswords(importFlags.BrokerPasswordsFile)
+	}
+	segmentGuids, missingSegments := isolationSegmentsPreflight(apiHelper, orgs, importFlags.OrgName)
+	if len(missingSegments) > 0 {
+		return "Error: isolation segments missing on target foundation: " + strings.Join(missingSegments, ", ") +
+			". Create them and register their cells before importing."
+	}
+	importPlatform(apiHelper, platformConfig, importFlags)
+	targetDefaults, err := apiHelper.GetSecurityGroups()
+	if nil != err {
+		log.Println("Warning: unable to read the default security groups of the target, binding exported defaults to their spaces")
+		log.Println(err)
+	}
+	if sshRequired(orgs, importFlags.OrgName) && !apiHelper.IsSSHEnabled() {
+		log.Println("Warning: target foundation has no app SSH endpoint, apps and spaces with SSH enabled will not be reachable.")
+	}
 	for _, org := range orgs {
 		if filterOrg && importFlags.OrgName != org.Name {
 			continue
 		}
-		output, err := apiHelper.CheckOrg(org.Name, true)
-		check(err)
+		output, precreated := createdOrgs[org.Name]
+		if !precreated {
+			output, err = apiHelper.CheckOrg(org.Name, true)
+			check(err)
+		}
 		iorg := ImportedOrg{
 			Guid: output.Guid,
 			Name: output.Name,
 		}
+		importMetadata(apiHelper, "/v3/organizations/"+iorg.Guid, org.Metadata, output.Created, org.Foundation, org.Guid)
+		importIsolationSegments(apiHelper, org, iorg.Guid, segmentGuids)
+		if org.Quota.Name != "" {
+			iquota, err := apiHelper.CheckQuota(apihelper.Quota{
+				Name:                    org.Quota.Name,
+				NonBasicServicesAllowed: org.Quota.NonBasicServicesAllowed,
+				TotalServices:           org.Quota.TotalServices,
+				TotalRoutes:             org.Quota.TotalRoutes,
+				TotalPrivateDomain:      org.Quota.TotalPrivateDomain,
+				MemoryLimit:             org.Quota.MemoryLimit,
+				TrialDBAllowed:          org.Quota.TrialDBAllowed,
+				InstanceMemoryLimit:     org.Quota.InstanceMemoryLimit,
+				AppInstanceLimit:        org.Quota.AppInstanceLimit,
+				AppTaskLimit:            org.Quota.AppTaskLimit,
+				TotalServiceKeys:        org.Quota.TotalServiceKeys,
+				TotalReservedRoutePorts: org.Quota.TotalReservedRoutePorts,
+			}, true)
+			if nil != err {
+				log.Println("Error: Skipping quota definition " + org.Quota.Name + " for org " + org.Name)
+				log.Println(err)
+			} else if nil == apiHelper.AssignOrgQuota(iorg.Guid, iquota.Guid) {
+				log.Println("Quota definition " + iquota.Name + " assigned to org " + org.Name + ".")
+				iorg.Quota = ImportedQuota{
+					Guid:   iquota.Guid,
+					Name:   iquota.Name,
+					Action: iquota.Action,
+				}
+				iorg.QuotaWarnings = quotaWarnings(org, iquota.Quota)
+				for _, warning := range iorg.QuotaWarnings {
+					log.Println("Warning: org " + org.Name + ": " + warning)
+				}
+			}
+		}
+		iorg.PrivateDomains = importPrivateDomains(apiHelper, org.PrivateDomains, iorg, importing, createdOrgs)
+		missingUsers := make(map[string]bool)
+		importRoles(apiHelper, org.Roles, iorg.Guid, "", userMappings, missingUsers)
+		importPlanVisibilities(apiHelper, org.PlanVisibilities, org.Name, iorg.Guid)
 		var ispaces ISpaces
 		for _, space := range org.Spaces {
-			output, err := apiHelper.CheckSpace(space.Name, iorg.Guid, true)
+			output, err := apiHelper.CheckSpace(space.Name, iorg.Guid, space.AllowSsh, true)
 			check(err)
 			ispace := ImportedSpace{
 				Guid: output.Guid,
 				Name: output.Name,
 			}
+			importMetadata(apiHelper, "/v3/spaces/"+ispace.Guid, space.Metadata, output.Created, org.Foundation, space.Guid)
+			if space.IsolationSegment != "" {
+				if nil == apiHelper.AssignIsolationSegment(segmentGuids[space.IsolationSegment], iorg.Guid, ispace.Guid) {
+					log.Println("Isolation segment " + space.IsolationSegment + " assigned to space " + space.Name + ".")
+				}
+			}
+			importRoles(apiHelper, space.Roles, iorg.Guid, ispace.Guid, userMappings, missingUsers)
+			if space.SpaceQuota.Name != "" {
+				iquota, err := apiHelper.CheckSpaceQuota(apihelper.SpaceQuota{
+					Name:                    space.SpaceQuota.Name,
+					NonBasicServicesAllowed: space.SpaceQuota.NonBasicServicesAllowed,
+					TotalServices:           space.SpaceQuota.TotalServices,
+					TotalRoutes:             space.SpaceQuota.TotalRoutes,
+					MemoryLimit:             space.SpaceQuota.MemoryLimit,
+					InstanceMemoryLimit:     space.SpaceQuota.InstanceMemoryLimit,
+					AppInstanceLimit:        space.SpaceQuota.AppInstanceLimit,
+					AppTaskLimit:            space.SpaceQuota.AppTaskLimit,
+					TotalServiceKeys:        space.SpaceQuota.TotalServiceKeys,
+					TotalReservedRoutePorts: space.SpaceQuota.TotalReservedRoutePorts,
+				}, iorg.Guid, true)
+				if nil != err {
+					log.Println("Error: Skipping space quota definition " + space.SpaceQuota.Name + " for space " + space.Name)
+					log.Println(err)
+				} else if nil == apiHelper.AssignSpaceQuota(iquota.Guid, ispace.Guid) {
+					log.Println("Space quota definition " + iquota.Name + " assigned to space " + space.Name + ".")
+					ispace.SpaceQuota = ImportedQuota{
+						Guid:   iquota.Guid,
+						Name:   iquota.Name,
+						Action: iquota.Action,
+					}
+				}
+			}
+			ispace.SecurityGroups = append(
+				importSecurityGroups(apiHelper, space.SecurityGroup, ispace.Guid, false, importFlags.UpdateSecurityGroups, importedSecurityGroups, targetDefaults),
+				importSecurityGroups(apiHelper, space.StagingSecurityGroup, ispace.Guid, true, importFlags.UpdateSecurityGroups, importedSecurityGroups, targetDefaults)...)
+			ispace.ServiceBrokers = importServiceBrokers(apiHelper, space.ServiceBrokers, org.Name+"/"+space.Name, ispace.Guid, brokerPasswords)
 			var iservices IServices
 			var rservices apihelper.IServices
 			for _, service := range space.Services {
+				if service.SharedFrom.Space != "" {
+					log.Println("Service instance " + service.InstanceName + " is shared from " + service.SharedFrom.Org + "/" + service.SharedFrom.Space + ", it will be shared once all spaces are imported.")
+					iservices = append(iservices, ImportedService{
+						Name:  service.InstanceName,
+						State: "shared",
+					})
+					rservices = append(rservices, apihelper.ImportedService{
+						Name:  service.InstanceName,
+						State: "shared",
+					})
+					sharedInstances = append(sharedInstances, sharedInstance{
+						Owner:     service.SharedFrom,
+						Service:   service,
+						Space:     org.Name + "/" + space.Name,
+						SpaceGuid: ispace.Guid,
+					})
+					continue
+				}
+				parameters := service.Parameters
+				if overrides, found := serviceOverrides[org.Name+"/"+space.Name+"/"+service.InstanceName]; found {
+					parameters = make(map[string]interface{})
+					for key, value := range service.Parameters {
+						parameters[key] = value
+					}
+					for key, value := range overrides {
+						parameters[key] = value
+					}
+				}
 				mservice := apihelper.Service{
-					InstanceName: service.InstanceName,
-					Label:        service.Label,
-					ServicePlan:  service.ServicePlan,
-					Type:         service.Type,
-					Credentials:  service.Credentials,
-					SyslogDrain:  service.SyslogDrain,
+					InstanceName:    service.InstanceName,
+					Label:           service.Label,
+					ServicePlan:     service.ServicePlan,
+					Type:            service.Type,
+					Credentials:     service.Credentials,
+					SyslogDrain:     service.SyslogDrain,
+					RouteServiceURL: service.RouteServiceURL,
+					Tags:            service.Tags,
+					Parameters:      parameters,
 				}
 				output, err := apiHelper.CheckServiceInstance(mservice, ispace.Guid, true)
 				check(err)
-				iservice := ImportedService{
-					Guid: output.Guid,
-					Name: output.Name,
+				if output.State == "in progress" && deadline.IsZero() {
+					deadline = time.Now().Add(importFlags.ServiceTimeout)
 				}
-				rservice := apihelper.ImportedService{
-					Guid: output.Guid,
-					Name: output.Name,
+				if output.Guid != "" {
+					importMetadata(apiHelper, "/v3/service_instances/"+output.Guid, service.Metadata, output.Created, org.Foundation, service.Guid)
+					ownedInstances[org.Name+"/"+space.Name+"/"+service.InstanceName] = output.Guid
+				}
+				iservices = append(iservices, ImportedService{
+					Guid:  output.Guid,
+					Name:  output.Name,
+					State: output.State,
+				})
+				rservices = append(rservices, output)
+			}
+			for idx, service := range space.Services {
+				switch rservices[idx].State {
+				case "succeeded":
+					iservicekeys = append(iservicekeys, importServiceKeys(apiHelper, org.Name, space.Name, service, rservices[idx].Guid)...)
+				case "in progress":
+					deferredKeys = append(deferredKeys, deferredServiceKeys{
+						Org:         org.Name,
+						Space:       space.Name,
+						Service:     service,
+						ServiceGuid: rservices[idx].Guid,
+					})
 				}
-				iservices = append(iservices, iservice)
-				rservices = append(rservices, rservice)
 			}
 			ispace.Services = iservices
 			var iapps IApps
 
 			for _, app := range space.Apps {
-				if !fileExists(app.Name+"_"+app.Guid+".src") {
+				if app.DockerImage == "" && !fileExists(app.Name+"_"+app.Guid+".src") {
 					skip_message := org.Name+"/"+space.Name+"/"+app.Name+"("+app.Guid+")"
 					log.Println("Error: Skipping creating app "+skip_message)
 					continue
 				}
 				if addRoute {
-					if app.URLs != nil && len(app.URLs) > 0 {
-						capp_urls := app.URLs
-						for _, url := range capp_urls {
-							hostname := strings.Split(url.(string), ".")[0]
-							app.URLs = append(app.URLs, hostname+"."+importFlags.Domain)
+					for _, route := range app.Routes {
+						if route.Port > 0 || route.RouterGroup != "" {
+							continue
 						}
+						app.Routes = append(app.Routes, Route{
+							Host:    route.Host,
+							Domain:  importFlags.Domain,
+							Path:    route.Path,
+							AppPort: route.AppPort,
+						})
 					}
 				}
+				routes := apihelper.Routes{}
+				for _, route := range app.Routes {
+					routes = append(routes, apihelper.Route{
+						Host:        route.Host,
+						Domain:      route.Domain,
+						Path:        route.Path,
+						Port:        route.Port,
+						AppPort:     route.AppPort,
+						RouterGroup: route.RouterGroup,
+					})
+				}
+				bindings := apihelper.ServiceBindings{}
+				var missingSecrets []string
+				for _, binding := range app.ServiceBindings {
+					parameters := binding.Parameters
+					if len(binding.VolumeMounts) > 0 {
+						secrets, found := volumeSecrets[org.Name+"/"+space.Name+"/"+app.Name+"/"+binding.InstanceName]
+						if !found {
+							log.Println("Warning: no volume secrets supplied for " + org.Name + "/" + space.Name + "/" + app.Name + "/" + binding.InstanceName + ", not binding it")
+							missingSecrets = append(missingSecrets, binding.InstanceName)
+							continue
+						}
+						parameters = volumeBindingParameters(binding, secrets)
+					}
+					bindings = append(bindings, apihelper.ServiceBinding{
+						InstanceName: binding.InstanceName,
+						Name:         binding.Name,
+						Parameters:   parameters,
+					})
+				}
+				serviceNames := []interface{}{}
+				for _, siname := range app.ServiceNames {
+					if !contains(missingSecrets, siname.(string)) {
+						serviceNames = append(serviceNames, siname)
+					}
+				}
+				sidecars := apihelper.Sidecars{}
+				for _, sidecar := range app.Sidecars {
+					sidecars = append(sidecars, apihelper.Sidecar{
+						Name:         sidecar.Name,
+						Command:      sidecar.Command,
+						ProcessTypes: sidecar.ProcessTypes,
+						Memory:       sidecar.Memory,
+					})
+				}
 				mapp := apihelper.App{
 					Guid:                    app.Guid,
 					Name:                    app.Name,
@@ -258,8 +801,18 @@ func ImportMetaAndBits(apiHelper apihelper.CFAPIHelper, importFlags ImportFlags)
 					Diego:                   app.Diego,
 					EnableSsh:               app.EnableSsh,
 					EnviornmentVar:          app.EnviornmentVar,
-					URLs:                    app.URLs,
-					ServiceNames:            app.ServiceNames,
+					Ports:                   app.Ports,
+					Routes:                  routes,
+					Buildpacks:              app.Buildpacks,
+					DetectedBuildpack:       app.DetectedBuildpack,
+					BuildpackVersion:        app.BuildpackVersion,
+					Stack:                   app.Stack,
+					DockerImage:             app.DockerImage,
+					DockerUsername:          app.DockerUsername,
+					DockerPassword:          importFlags.DockerPassword,
+					Sidecars:                sidecars,
+					ServiceNames:            serviceNames,
+					ServiceBindings:         bindings,
 				}
 				output, err := apiHelper.CheckApp(mapp, rservices, ispace.Guid, true)
 				check(err)
@@ -269,19 +822,180 @@ func ImportMetaAndBits(apiHelper apihelper.CFAPIHelper, importFlags ImportFlags)
 					Droplet: output.Droplet,
 					Src:     output.Src,
 					OrgState: output.OrgState,
+					Docker:   output.Docker,
+					Startable: len(output.FailedServices) == 0 && len(missingSecrets) == 0,
+				}
+				if iapp.Guid != "" {
+					appProcesses[iapp.Guid] = app.Processes
+					importMetadata(apiHelper, "/v3/apps/"+iapp.Guid, app.Metadata, output.Created, org.Foundation, app.Guid)
+				}
+				for _, siname := range output.FailedServices {
+					iapp.BlockedBy = append(iapp.BlockedBy, siname+" (failed)")
+				}
+				for _, siname := range missingSecrets {
+					iapp.BlockedBy = append(iapp.BlockedBy, siname+" (volume secrets missing)")
+				}
+				for _, siname := range output.DeferredServices {
+					for _, rservice := range rservices {
+						if rservice.Name == siname {
+							deferredBindings = append(deferredBindings, deferredBinding{
+								AppGuid:      iapp.Guid,
+								SpaceGuid:    ispace.Guid,
+								InstanceName: siname,
+								ServiceGuid:  rservice.Guid,
+								Binding:      bindings.Find(siname),
+							})
+						}
+					}
 				}
 				iapps = append(iapps, iapp)
 			}
 			ispace.Apps = iapps
+			for _, service := range space.Services {
+				siguid := ""
+				for _, rservice := range rservices {
+					if rservice.Name == service.InstanceName {
+						siguid = rservice.Guid
+					}
+				}
+				if siguid == "" {
+					continue
+				}
+				for _, route := range service.Routes {
+					err := apiHelper.BindRouteService(siguid, service.Type, apihelper.Route{
+						Host:   route.Host,
+						Domain: route.Domain,
+						Path:   route.Path,
+						Port:   route.Port,
+					}, ispace.Guid)
+					if nil == err {
+						continue
+					}
+					routeName := route.Domain + route.Path
+					if route.Host != "" {
+						routeName = route.Host + "." + routeName
+					}
+					log.Println("Error: route " + routeName + " not bound to route service instance " + service.InstanceName)
+					log.Println(err)
+					// apps behind the route would serve traffic without passing through the route service
+					for k, iapp := range ispace.Apps {
+						for _, app := range space.Apps {
+							if app.Name == iapp.Name && hasRoute(app.Routes, route) {
+								ispace.Apps[k].Startable = false
+								ispace.Apps[k].BlockedBy = append(ispace.Apps[k].BlockedBy, service.InstanceName+" (route service binding failed)")
+							}
+						}
+					}
+				}
+			}
 			ispaces = append(ispaces, ispace)
 		}
 		iorg.Spaces = ispaces
+		for user := range missingUsers {
+			iorg.MissingUsers = append(iorg.MissingUsers, user)
+		}
+		sort.Strings(iorg.MissingUsers)
+		if len(iorg.MissingUsers) > 0 {
+			log.Println("Warning: users missing on target for org " + org.Name + ": " + strings.Join(iorg.MissingUsers, ", "))
+		}
 		iorgs = append(iorgs, iorg)
 	}
 
+	importNetworkPolicies(apiHelper, orgs, iorgs)
+
+	if len(sharedInstances) > 0 {
+		sharedGuids := shareServiceInstances(apiHelper, sharedInstances, ownedInstances)
+		for i, binding := range deferredBindings {
+			if binding.ServiceGuid == "" {
+				deferredBindings[i].ServiceGuid = sharedGuids[binding.SpaceGuid+"/"+binding.InstanceName]
+			}
+		}
+		for i := range iorgs {
+			for j, space := range iorgs[i].Spaces {
+				for k, service := range space.Services {
+					if service.State == "shared" {
+						iorgs[i].Spaces[j].Services[k].Guid = sharedGuids[space.Guid+"/"+service.Name]
+					}
+				}
+			}
+		}
+	}
+
+	if len(deferredBindings) > 0 || len(deferredKeys) > 0 {
+		blocked := make(map[string][]string)
+		states := make(map[string]string)
+		waitFor := func(siguid string) string {
+			if _, done := states[siguid]; !done {
+				if deadline.IsZero() {
+					deadline = time.Now().Add(importFlags.ServiceTimeout)
+				}
+				state, err := apiHelper.WaitForServiceInstance(siguid, deadline)
+				if nil != err {
+					log.Println(err)
+					state = "failed"
+				}
+				states[siguid] = state
+			}
+			return states[siguid]
+		}
+		for _, binding := range deferredBindings {
+			if binding.ServiceGuid == "" {
+				log.Println("Service instance (" + binding.InstanceName + ") is not shared into the space, not binding it to app (" + binding.AppGuid + ").")
+				blocked[binding.AppGuid] = append(blocked[binding.AppGuid], binding.InstanceName+" (not shared)")
+				continue
+			}
+			state := waitFor(binding.ServiceGuid)
+			if state != "succeeded" {
+				log.Println("Service instance (" + binding.InstanceName + ") is " + state + ", not binding it to app (" + binding.AppGuid + ").")
+				blocked[binding.AppGuid] = append(blocked[binding.AppGuid], binding.InstanceName+" ("+state+")")
+				continue
+			}
+			if nil != apiHelper.BindService(binding.ServiceGuid, binding.AppGuid, binding.Binding) {
+				blocked[binding.AppGuid] = append(blocked[binding.AppGuid], binding.InstanceName+" (bind failed)")
+				continue
+			}
+			log.Println("Service instance (" + binding.InstanceName + ") bounded to app (" + binding.AppGuid + ").")
+		}
+		for _, keys := range deferredKeys {
+			if waitFor(keys.ServiceGuid) == "succeeded" {
+				iservicekeys = append(iservicekeys, importServiceKeys(apiHelper, keys.Org, keys.Space, keys.Service, keys.ServiceGuid)...)
+			}
+		}
+		for i := range iorgs {
+			for j := range iorgs[i].Spaces {
+				for k, service := range iorgs[i].Spaces[j].Services {
+					if state, found := states[service.Guid]; found {
+						iorgs[i].Spaces[j].Services[k].State = state
+					}
+				}
+				for k, app := range iorgs[i].Spaces[j].Apps {
+					if reasons, found := blocked[app.Guid]; found {
+						iorgs[i].Spaces[j].Apps[k].Startable = false
+						iorgs[i].Spaces[j].Apps[k].BlockedBy = append(app.BlockedBy, reasons...)
+					}
+				}
+			}
+		}
+	}
+	for _, org := range iorgs {
+		for _, space := range org.Spaces {
+			for _, app := range space.Apps {
+				if !app.Startable {
+					log.Println("Warning: app " + org.Name + "/" + space.Name + "/" + app.Name + " is not startable, service instances not bound: " + strings.Join(app.BlockedBy, ", "))
+				}
+			}
+		}
+	}
+
 	b, _ := json.MarshalIndent(iorgs, "", "\t")
-	err := ioutil.WriteFile("imported_apps.json", b, 0644)
+	err = ioutil.WriteFile("imported_apps.json", b, 0644)
 	check(err)
+	if len(iservicekeys) > 0 {
+		b, _ = json.MarshalIndent(iservicekeys, "", "\t")
+		err = ioutil.WriteFile("service_keys.json", b, 0600)
+		check(err)
+		log.Println("Wrote credentials of ", len(iservicekeys), " service keys to service_keys.json")
+	}
 
 	rand.Seed(time.Now().UnixNano())
 	// Typical use-case:
@@ -296,8 +1010,11 @@ func ImportMetaAndBits(apiHelper apihelper.CFAPIHelper, importFlags ImportFlags)
 	i := 0
 	for _, org := range iorgs {
 		for _, space := range org.Spaces {
-			i += len(space.Apps) * 2
 			for _, app := range space.Apps {
+				if app.Docker {
+					continue
+				}
+				i += 2
 				droplet_swg.Add()
 				go apiHelper.PutBlob("/v2/apps/"+app.Guid+"/droplet/upload", app.Droplet, &droplet_swg)
 				src_swg.Add()
@@ -317,11 +1034,51 @@ func ImportMetaAndBits(apiHelper apihelper.CFAPIHelper, importFlags ImportFlags)
 	droplet_swg.Wait()
 	src_swg.Wait()
 
+	dropletDeadline := time.Now().Add(dropletTimeout)
+	for i := range iorgs {
+		for j := range iorgs[i].Spaces {
+			for k, app := range iorgs[i].Spaces[j].Apps {
+				processes, found := appProcesses[app.Guid]
+				if !found || len(processes) == 0 {
+					continue
+				}
+				// process types other than web only exist once the uploaded droplet is processed
+				if !app.Docker {
+					if err := apiHelper.WaitForDroplet(app.Guid, dropletDeadline); nil != err {
+						log.Println(err)
+					}
+				}
+				for _, process := range processes {
+					err := apiHelper.ScaleProcess(app.Guid, apihelper.Process{
+						Type:                         process.Type,
+						Command:                      process.Command,
+						Instances:                    process.Instances,
+						Memory:                       process.Memory,
+						DiskQuota:                    process.DiskQuota,
+						HealthCheckType:              process.HealthCheckType,
+						HealthCheckTimeout:           process.HealthCheckTimeout,
+						HealthCheckInvocationTimeout: process.HealthCheckInvocationTimeout,
+						HealthCheckHttpEndpoint:      process.HealthCheckHttpEndpoint,
+					})
+					if nil != err {
+						iorgs[i].Spaces[j].Apps[k].SkippedProcesses = append(iorgs[i].Spaces[j].Apps[k].SkippedProcesses, process.Type)
+					}
+				}
+				if skipped := iorgs[i].Spaces[j].Apps[k].SkippedProcesses; len(skipped) > 0 {
+					log.Println("Warning: app " + iorgs[i].Name + "/" + iorgs[i].Spaces[j].Name + "/" + app.Name + " not scaled for process types: " + strings.Join(skipped, ", "))
+				}
+			}
+		}
+	}
+	b, _ = json.MarshalIndent(iorgs, "", "\t")
+	err = ioutil.WriteFile("imported_apps.json", b, 0644)
+	check(err)
+
 	if importFlags.RestoreState {
 		for _, org := range iorgs {
 			for _, space := range org.Spaces {
 				for _, app := range space.Apps {
-					if app.OrgState != "" && app.OrgState == "STARTED" {
+					if app.Startable && app.OrgState == "STARTED" {
 						apiHelper.StartApp(app.Guid)
 					}
 				}
@@ -331,6 +1088,689 @@ func ImportMetaAndBits(apiHelper apihelper.CFAPIHelper, importFlags ImportFlags)
 	return "Succefully imported apps metadata from apps.json file and uploaded all bits."
 }
 
+//hasRoute reports whether the routes contain the route, ignoring the app port
+func hasRoute(routes Routes, route Route) bool {
+	for _, r := range routes {
+		if r.Host == route.Host && r.Domain == route.Domain && r.Path == route.Path && r.Port == route.Port {
+			return true
+		}
+	}
+	return false
+}
+
+//importNetworkPolicies recreates the network policies of the imported spaces once all apps have their new guids.
+//Policies whose source or destination app was not imported are skipped.
+func importNetworkPolicies(apiHelper apihelper.CFAPIHelper, orgs Orgs, iorgs IOrgs) {
+	guids := make(map[AppRef]string)
+	for _, org := range iorgs {
+		for _, space := range org.Spaces {
+			for _, app := range space.Apps {
+				guids[AppRef{Org: org.Name, Space: space.Name, App: app.Name}] = app.Guid
+			}
+		}
+	}
+	policies := apihelper.NetworkPolicies{}
+	for _, org := range orgs {
+		for _, space := range org.Spaces {
+			for _, policy := range space.NetworkPolicies {
+				sourceGuid, sourceFound := guids[policy.Source]
+				destinationGuid, destinationFound := guids[policy.Destination]
+				if !sourceFound || !destinationFound {
+					continue
+				}
+				policies = append(policies, apihelper.NetworkPolicy{
+					SourceGuid:      sourceGuid,
+					DestinationGuid: destinationGuid,
+					Protocol:        policy.Protocol,
+					StartPort:       policy.StartPort,
+					EndPort:         policy.EndPort,
+				})
+			}
+		}
+	}
+	if len(policies) == 0 {
+		return
+	}
+	if nil == apiHelper.CreateNetworkPolicies(policies) {
+		log.Println("Created ", len(policies), " network policies.")
+	}
+}
+
+//importPlatformConfig applies the exported feature flags and environment variable groups, logging what changes on the target
+func importPlatformConfig(apiHelper apihelper.CFAPIHelper, config PlatformConfig) {
+	current, err := apiHelper.GetPlatformConfig()
+	if nil != err {
+		log.Println("Error: Skipping platform configuration, unable to read it from target")
+		log.Println(err)
+		return
+	}
+	names := []string{}
+	for name := range config.FeatureFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		enabled := config.FeatureFlags[name]
+		currentlyEnabled, found := current.FeatureFlags[name]
+		if !found {
+			log.Println("Warning: feature flag " + name + " does not exist on target.")
+			continue
+		}
+		if currentlyEnabled == enabled {
+			continue
+		}
+		log.Println(fmt.Sprintf("Feature flag %s: %t -> %t", name, currentlyEnabled, enabled))
+		apiHelper.SetFeatureFlag(name, enabled)
+	}
+	importEnvironmentVariableGroup(apiHelper, "running", config.RunningEnvironmentVariables, current.RunningEnvironmentVariables)
+	importEnvironmentVariableGroup(apiHelper, "staging", config.StagingEnvironmentVariables, current.StagingEnvironmentVariables)
+}
+
+//importPlatform applies the exported platform configuration and admin buildpacks selected by the import flags
+func importPlatform(apiHelper apihelper.CFAPIHelper, platformConfig *PlatformConfig, importFlags ImportFlags) {
+	if importFlags.PlatformConfig {
+		if nil == platformConfig {
+			log.Println("Warning: apps.json has no platform configuration, export it as admin without -o.")
+		} else {
+			importPlatformConfig(apiHelper, *platformConfig)
+			importDefaultSecurityGroups(apiHelper, platformConfig.SecurityGroups, importFlags.UpdateSecurityGroups)
+		}
+	}
+	if importFlags.Buildpacks {
+		if nil == platformConfig || len(platformConfig.Buildpacks) == 0 {
+			log.Println("Warning: apps.json has no admin buildpacks, export them as admin with -bp true.")
+		} else {
+			importBuildpacks(apiHelper, platformConfig.Buildpacks)
+		}
+	}
+}
+
+//importBuildpacks creates the admin buildpacks missing on the target in their exported order and uploads their bits.
+//Buildpacks are locked only once their bits are uploaded. Existing buildpacks are left unchanged.
+func importBuildpacks(apiHelper apihelper.CFAPIHelper, buildpacks Buildpacks) {
+	for _, buildpack := range buildpacks {
+		filename := buildpackFile(buildpack)
+		if buildpack.Filename != "" && !fileExists(filename) {
+			log.Println("Error: Skipping buildpack " + buildpack.Name + ", " + filename + " not found")
+			continue
+		}
+		ibuildpack, err := apiHelper.CheckBuildpack(apihelper.Buildpack{
+			Name:     buildpack.Name,
+			Position: buildpack.Position,
+			Stack:    buildpack.Stack,
+			Enabled:  buildpack.Enabled,
+		}, true)
+		if nil != err {
+			log.Println("Error: Skipping buildpack " + buildpack.Name)
+			log.Println(err)
+			continue
+		}
+		if ibuildpack.Action != "created" {
+			continue
+		}
+		if buildpack.Filename != "" {
+			if err := apiHelper.UploadBuildpack(ibuildpack.Guid, filename); nil != err {
+				log.Println("Error: buildpack " + buildpack.Name + " created without bits, not locking it")
+				log.Println(err)
+				continue
+			}
+		}
+		if buildpack.Locked {
+			apiHelper.LockBuildpack(ibuildpack.Guid)
+		}
+		log.Println("Buildpack " + buildpack.Name + " created at position " + fmt.Sprint(buildpack.Position) + ".")
+	}
+}
+
+//importEnvironmentVariableGroup makes the target environment variable group match the exported one.
+//Only the names of the variables that change are logged.
+func importEnvironmentVariableGroup(apiHelper apihelper.CFAPIHelper, group string, vars map[string]interface{}, current map[string]interface{}) {
+	changes := make(map[string]interface{})
+	for name, value := range vars {
+		if currentValue, found := current[name]; !found {
+			changes[name] = value
+		} else if fmt.Sprint(currentValue) != fmt.Sprint(value) {
+			changes[name] = value
+		}
+	}
+	for name := range current {
+		if _, found := vars[name]; !found {
+			changes[name] = nil
+		}
+	}
+	if len(changes) == 0 {
+		log.Println("The " + group + " environment variable group is unchanged.")
+		return
+	}
+	names := []string{}
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		action := "changed"
+		if _, found := current[name]; !found {
+			action = "added"
+		} else if nil == changes[name] {
+			action = "removed"
+		}
+		log.Println("Environment variable " + name + " of the " + group + " group " + action + ".")
+	}
+	apiHelper.SetEnvironmentVariableGroup(group, changes)
+}
+
+//sshRequired reports whether a space or an app to import has SSH enabled
+func sshRequired(orgs Orgs, orgName string) bool {
+	for _, org := range orgs {
+		if orgName != "" && orgName != org.Name {
+			continue
+		}
+		for _, space := range org.Spaces {
+			if nil != space.AllowSsh && *space.AllowSsh {
+				return true
+			}
+			for _, app := range space.Apps {
+				if app.EnableSsh {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+//isolationSegmentsPreflight looks up the isolation segments used by the orgs to import on the target,
+//returning their guids by name and the names of the segments missing on the target
+func isolationSegmentsPreflight(apiHelper apihelper.CFAPIHelper, orgs Orgs, orgName string) (map[string]string, []string) {
+	guids := make(map[string]string)
+	var missing []string
+	lookup := func(name string) {
+		if _, done := guids[name]; done || name == "" {
+			return
+		}
+		guid, err := apiHelper.GetIsolationSegmentGuid(name)
+		if nil != err {
+			log.Println("Isolation segment " + name + " not found on target: " + err.Error())
+			missing = append(missing, name)
+		}
+		guids[name] = guid
+	}
+	for _, org := range orgs {
+		if orgName != "" && orgName != org.Name {
+			continue
+		}
+		for _, name := range org.IsolationSegments {
+			lookup(name)
+		}
+		lookup(org.DefaultIsolationSegment)
+		for _, space := range org.Spaces {
+			lookup(space.IsolationSegment)
+		}
+	}
+	return guids, missing
+}
+
+//importIsolationSegments entitles the org to its exported isolation segments, including the ones its spaces
+//are assigned to, and restores its default segment
+func importIsolationSegments(apiHelper apihelper.CFAPIHelper, org Org, orgguid string, guids map[string]string) {
+	names := append([]string{}, org.IsolationSegments...)
+	names = append(names, org.DefaultIsolationSegment)
+	for _, space := range org.Spaces {
+		names = append(names, space.IsolationSegment)
+	}
+	entitled := make(map[string]bool)
+	for _, name := range names {
+		if name == "" || entitled[name] {
+			continue
+		}
+		entitled[name] = true
+		if nil == apiHelper.EntitleIsolationSegment(guids[name], orgguid) {
+			log.Println("Org " + org.Name + " entitled to isolation segment " + name + ".")
+		}
+	}
+	if org.DefaultIsolationSegment != "" {
+		if nil == apiHelper.AssignIsolationSegment(guids[org.DefaultIsolationSegment], orgguid, "") {
+			log.Println("Isolation segment " + org.DefaultIsolationSegment + " set as default of org " + org.Name + ".")
+		}
+	}
+}
+
+//importMetadata reapplies the exported labels and annotations of a resource. Resources created by the
+//import are also annotated with the foundation and guid they were cloned from.
+func importMetadata(apiHelper apihelper.CFAPIHelper, resourceURL string, metadata Metadata, created bool, foundation string, sourceGuid string) {
+	annotations := make(map[string]string)
+	for key, value := range metadata.Annotations {
+		annotations[key] = value
+	}
+	if created {
+		if foundation != "" {
+			annotations["clone-apps/source-foundation"] = foundation
+		}
+		if sourceGuid != "" {
+			annotations["clone-apps/source-guid"] = sourceGuid
+		}
+	}
+	if len(metadata.Labels) == 0 && len(annotations) == 0 {
+		return
+	}
+	apiHelper.SetMetadata(resourceURL, apihelper.Metadata{
+		Labels:      metadata.Labels,
+		Annotations: annotations,
+	})
+}
+
+//volumeBindingParameters returns the bind parameters of a volume service binding: the exported mount path and
+//read-only mode merged with the exported binding parameters and the secrets supplied at import (uid, gid, username, password...)
+func volumeBindingParameters(binding ServiceBinding, secrets map[string]interface{}) map[string]interface{} {
+	parameters := make(map[string]interface{})
+	for key, value := range binding.Parameters {
+		parameters[key] = value
+	}
+	// the volume service bind parameters accept a single mount per binding
+	mount := binding.VolumeMounts[0]
+	for _, dropped := range binding.VolumeMounts[1:] {
+		log.Println("Warning: binding to " + binding.InstanceName + " supports a single mount, dropping mount " + dropped.ContainerDir + " (" + dropped.Mode + ")")
+	}
+	parameters["mount"] = mount.ContainerDir
+	if mount.Mode == "r" {
+		parameters["readonly"] = true
+	}
+	for key, value := range secrets {
+		parameters[key] = value
+	}
+	return parameters
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//shareServiceInstances shares the instances owned by another space into the spaces they were shared with on the source.
+//The owning instance is taken from the instances created by this import, or looked up on the target when its org was not imported.
+//It returns the guids of the shared instances keyed by space guid and instance name.
+func shareServiceInstances(apiHelper apihelper.CFAPIHelper, shared []sharedInstance, owned map[string]string) map[string]string {
+	guids := make(map[string]string)
+	for _, instance := range shared {
+		owner := instance.Owner.Org + "/" + instance.Owner.Space + "/" + instance.Service.InstanceName
+		siguid, found := owned[owner]
+		if !found {
+			siguid = findServiceInstance(apiHelper, instance.Owner, instance.Service)
+		}
+		if siguid == "" {
+			log.Println("Error: service instance " + owner + " not found on target, not sharing it into " + instance.Space)
+			continue
+		}
+		result, err := apiHelper.ShareServiceInstance(siguid, instance.SpaceGuid)
+		if nil != err {
+			log.Println("Error: unable to share service instance " + owner + " into " + instance.Space)
+			log.Println(err)
+			continue
+		}
+		log.Println("Service instance " + owner + " shared into " + instance.Space + " (" + result + ").")
+		guids[instance.SpaceGuid+"/"+instance.Service.InstanceName] = siguid
+	}
+	return guids
+}
+
+//findServiceInstance returns the guid of a service instance on the target by org, space and instance name, or ""
+func findServiceInstance(apiHelper apihelper.CFAPIHelper, space SpaceRef, service Service) string {
+	org, err := apiHelper.GetOrg(space.Org)
+	if nil != err {
+		return ""
+	}
+	ispace, err := apiHelper.CheckSpace(space.Space, org.Guid, nil, false)
+	if nil != err || ispace.Guid == "" {
+		return ""
+	}
+	siguid, _ := apiHelper.GetServiceInstanceGuid(service.InstanceName, service.Type, ispace.Guid)
+	return siguid
+}
+
+//importServiceBrokers registers the space scoped brokers before the space's service instances are created.
+//Brokers without a password in the passwords file are skipped.
+func importServiceBrokers(apiHelper apihelper.CFAPIHelper, brokers ServiceBrokers, spacePath string, spaceguid string, passwords BrokerPasswords) IServiceBrokers {
+	var ibrokers IServiceBrokers
+	for _, broker := range brokers {
+		password, found := passwords[spacePath+"/"+broker.Name]
+		if !found {
+			log.Println("Warning: no password supplied for service broker " + spacePath + "/" + broker.Name + ", skipping it")
+			ibrokers = append(ibrokers, ImportedServiceBroker{
+				Name:   broker.Name,
+				Action: "skipped",
+			})
+			continue
+		}
+		output, err := apiHelper.CheckServiceBroker(apihelper.ServiceBroker{
+			Name:     broker.Name,
+			URL:      broker.URL,
+			Username: broker.Username,
+		}, password, spaceguid, true)
+		if nil != err {
+			log.Println("Error: Skipping service broker " + spacePath + "/" + broker.Name)
+			log.Println(err)
+			continue
+		}
+		ibrokers = append(ibrokers, ImportedServiceBroker{
+			Guid:   output.Guid,
+			Name:   output.Name,
+			Action: output.Action,
+		})
+	}
+	return ibrokers
+}
+
+//importPlanVisibilities makes the exported service plans visible to the org again
+func importPlanVisibilities(apiHelper apihelper.CFAPIHelper, visibilities PlanVisibilities, orgName string, orgguid string) {
+	for _, visibility := range visibilities {
+		result, err := apiHelper.AddPlanVisibility(apihelper.PlanVisibility{
+			Service: visibility.Service,
+			Plan:    visibility.Plan,
+		}, orgguid)
+		if nil != err {
+			log.Println("Error: Skipping visibility of service plan " + visibility.Service + "/" + visibility.Plan + " for org " + orgName)
+			log.Println(err)
+			continue
+		}
+		log.Println("Service plan " + visibility.Service + "/" + visibility.Plan + " visible to org " + orgName + " (" + result + ").")
+	}
+}
+
+//importServiceKeys recreates the service keys of a provisioned service instance
+func importServiceKeys(apiHelper apihelper.CFAPIHelper, orgName string, spaceName string, service Service, siguid string) IServiceKeys {
+	var ikeys IServiceKeys
+	for _, key := range service.ServiceKeys {
+		output, err := apiHelper.CheckServiceKey(apihelper.ServiceKey{
+			Name:       key.Name,
+			Parameters: key.Parameters,
+		}, siguid, true)
+		if nil != err {
+			log.Println("Error: Skipping service key " + key.Name + " of service instance " + service.InstanceName)
+			log.Println(err)
+			continue
+		}
+		ikeys = append(ikeys, ImportedServiceKey{
+			Org:             orgName,
+			Space:           spaceName,
+			ServiceInstance: service.InstanceName,
+			Name:            output.Name,
+			Credentials:     output.Credentials,
+		})
+	}
+	return ikeys
+}
+
+//importPrivateDomains creates the private domains owned by the org and shares the ones owned by
+//other orgs with it, creating them under their owning org first when needed. The owning org is only
+//created when it is part of this import, otherwise the domain is created under the importing org.
+func importPrivateDomains(apiHelper apihelper.CFAPIHelper, domains PrivateDomains, iorg ImportedOrg, importing map[string]bool, createdOrgs map[string]apihelper.ImportedOrg) IDomains {
+	var idomains IDomains
+	for _, domain := range domains {
+		if domain.OwningOrganization == iorg.Name {
+			output, err := apiHelper.CheckPrivateDomain(domain.Name, iorg.Guid, true)
+			if nil != err {
+				log.Println("Error: Skipping private domain " + domain.Name)
+				log.Println(err)
+				continue
+			}
+			idomains = append(idomains, ImportedDomain{
+				Guid:   output.Guid,
+				Name:   output.Name,
+				Action: output.Action,
+			})
+			continue
+		}
+		owner, found := createdOrgs[domain.OwningOrganization]
+		if !found {
+			var err error
+			owner, err = apiHelper.CheckOrg(domain.OwningOrganization, importing[domain.OwningOrganization])
+			if nil != err {
+				log.Println("Error: Skipping private domain " + domain.Name)
+				log.Println(err)
+				continue
+			}
+			if owner.Created {
+				createdOrgs[domain.OwningOrganization] = owner
+			}
+		}
+		if owner.Guid == "" {
+			log.Println("Warning: owning org " + domain.OwningOrganization + " of private domain " + domain.Name + " is not on the target foundation and not imported, creating the domain under org " + iorg.Name + ".")
+			output, err := apiHelper.CheckPrivateDomain(domain.Name, iorg.Guid, true)
+			if nil != err {
+				log.Println("Error: Skipping private domain " + domain.Name)
+				log.Println(err)
+				continue
+			}
+			idomains = append(idomains, ImportedDomain{
+				Guid:   output.Guid,
+				Name:   output.Name,
+				Action: output.Action,
+			})
+			continue
+		}
+		output, err := apiHelper.CheckPrivateDomain(domain.Name, owner.Guid, true)
+		if nil != err {
+			log.Println("Error: Skipping private domain " + domain.Name)
+			log.Println(err)
+			continue
+		}
+		if nil == apiHelper.SharePrivateDomain(output.Guid, iorg.Guid) {
+			log.Println("Private domain " + domain.Name + " shared with org " + iorg.Name + ".")
+			idomains = append(idomains, ImportedDomain{
+				Guid:   output.Guid,
+				Name:   output.Name,
+				Action: output.Action + ",shared",
+			})
+		}
+	}
+	return idomains
+}
+
+//importRoles reassigns org roles (spaceguid empty) or space roles, applying the user mappings.
+//Org users are assigned first since every other role requires org membership.
+//Users that do not exist on the target are recorded in missing.
+func importRoles(apiHelper apihelper.CFAPIHelper, roles Roles, orgguid string, spaceguid string, mappings UserMappings, missing map[string]bool) {
+	var ordered Roles
+	for _, role := range roles {
+		if role.Type == "organization_user" {
+			ordered = append(Roles{role}, ordered...)
+		} else {
+			ordered = append(ordered, role)
+		}
+	}
+	for _, role := range ordered {
+		username := role.Username
+		origin := role.Origin
+		if mapping, found := mappings[role.Username]; found {
+			username = mapping.Username
+			if mapping.Origin != "" {
+				origin = mapping.Origin
+			}
+		}
+		action, err := apiHelper.AssignRole(apihelper.Role{
+			Type:     role.Type,
+			Username: username,
+			Origin:   origin,
+		}, orgguid, spaceguid)
+		if nil != err {
+			log.Println(err)
+			continue
+		}
+		if action == "missing" {
+			missing[username+" ("+origin+")"] = true
+		}
+	}
+}
+
+//quotaWarnings reports the limits of the target quota that are smaller than what the exported apps require.
+//A limit of -1 means unlimited.
+func quotaWarnings(org Org, quota apihelper.Quota) []string {
+	var warnings []string
+	var memory, instances, services float64
+	routes := make(map[Route]bool)
+	for _, space := range org.Spaces {
+		for _, app := range space.Apps {
+			memory += app.Memory * app.Instances
+			instances += app.Instances
+			for _, route := range app.Routes {
+				// a route mapped to several apps or app ports counts once against the quota
+				route.AppPort = 0
+				routes[route] = true
+			}
+			if quota.InstanceMemoryLimit != -1 && app.Memory > quota.InstanceMemoryLimit {
+				warnings = append(warnings, fmt.Sprintf("app %s/%s needs %.0fMB per instance, quota %s allows %.0fMB",
+					space.Name, app.Name, app.Memory, quota.Name, quota.InstanceMemoryLimit))
+			}
+		}
+		for _, service := range space.Services {
+			if service.Type == "managed" {
+				services++
+			}
+		}
+	}
+	if quota.MemoryLimit != -1 && memory > quota.MemoryLimit {
+		warnings = append(warnings, fmt.Sprintf("apps need %.0fMB of memory, quota %s allows %.0fMB", memory, quota.Name, quota.MemoryLimit))
+	}
+	if quota.AppInstanceLimit != -1 && instances > quota.AppInstanceLimit {
+		warnings = append(warnings, fmt.Sprintf("apps need %.0f instances, quota %s allows %.0f", instances, quota.Name, quota.AppInstanceLimit))
+	}
+	if quota.TotalServices != -1 && services > quota.TotalServices {
+		warnings = append(warnings, fmt.Sprintf("apps need %.0f service instances, quota %s allows %.0f", services, quota.Name, quota.TotalServices))
+	}
+	if quota.TotalRoutes != -1 && float64(len(routes)) > quota.TotalRoutes {
+		warnings = append(warnings, fmt.Sprintf("apps need %d routes, quota %s allows %.0f", len(routes), quota.Name, quota.TotalRoutes))
+	}
+	return warnings
+}
+
+//importSecurityGroups recreates the space's security groups on the target and binds them
+//to the space for the given lifecycle. Source platform default groups are only left unbound when the target
+//already has a default group of the same name for the lifecycle, so their egress rules are not lost.
+func importSecurityGroups(apiHelper apihelper.CFAPIHelper, sgs SecurityGroups, spaceguid string, staging bool, update bool, imported map[string]apihelper.ImportedSecurityGroup, targetDefaults map[string]apihelper.SecurityGroup) ISecurityGroups {
+	var isgs ISecurityGroups
+	lifecycle := "running"
+	if staging {
+		lifecycle = "staging"
+	}
+	for _, sg := range sgs {
+		output, found := imported[sg.Name]
+		if !found {
+			var err error
+			output, err = apiHelper.CheckSecurityGroup(toAPISecurityGroup(sg), update)
+			if nil != err {
+				log.Println("Error: Skipping security group " + sg.Name)
+				log.Println(err)
+				continue
+			}
+			imported[sg.Name] = output
+		}
+		isg := ImportedSecurityGroup{
+			Guid:      output.Guid,
+			Name:      output.Name,
+			Action:    output.Action,
+			Lifecycle: lifecycle,
+		}
+		target := targetDefaults[sg.Name]
+		if (staging && target.StagingDefault) || (!staging && target.RunningDefault) {
+			log.Println("Security group " + sg.Name + " is a " + lifecycle + " default on target, not binding it to space.")
+		} else if err := apiHelper.BindSecurityGroup(output.Guid, spaceguid, staging); nil == err {
+			log.Println("Security group " + sg.Name + " bound to space (" + spaceguid + ") for " + lifecycle + ".")
+			isg.Action = isg.Action + ",bound"
+		}
+		isgs = append(isgs, isg)
+	}
+	return isgs
+}
+
+//importDefaultSecurityGroups recreates the platform default security groups and adds them to the running and staging
+//default sets. Rules that differ from a group of the same name on the target and target defaults missing on the
+//source are reported, groups are only updated with update and never removed from the default sets.
+func importDefaultSecurityGroups(apiHelper apihelper.CFAPIHelper, sgs SecurityGroups, update bool) {
+	if len(sgs) == 0 {
+		return
+	}
+	current, err := apiHelper.GetSecurityGroups()
+	if nil != err {
+		log.Println("Error: Skipping default security groups, unable to read them from target")
+		log.Println(err)
+		return
+	}
+	targetGroups := make(map[string]apihelper.SecurityGroup)
+	for _, sg := range current {
+		targetGroups[sg.Name] = sg
+	}
+	exported := make(map[string]bool)
+	for _, sg := range sgs {
+		exported[sg.Name] = true
+		group := toAPISecurityGroup(sg)
+		target, found := targetGroups[sg.Name]
+		if found {
+			for _, rule := range ruleDiff(group.Rules, target.Rules) {
+				log.Println("Security group " + sg.Name + ": rule only on source: " + rule)
+			}
+			for _, rule := range ruleDiff(target.Rules, group.Rules) {
+				log.Println("Security group " + sg.Name + ": rule only on target: " + rule)
+			}
+		}
+		output, err := apiHelper.CheckSecurityGroup(group, update)
+		if nil != err {
+			log.Println("Error: Skipping default security group " + sg.Name)
+			log.Println(err)
+			continue
+		}
+		if sg.RunningDefault && !target.RunningDefault && nil == apiHelper.SetDefaultSecurityGroup(output.Guid, false) {
+			log.Println("Security group " + sg.Name + " added to the running defaults.")
+		}
+		if sg.StagingDefault && !target.StagingDefault && nil == apiHelper.SetDefaultSecurityGroup(output.Guid, true) {
+			log.Println("Security group " + sg.Name + " added to the staging defaults.")
+		}
+	}
+	for name, sg := range targetGroups {
+		if (sg.RunningDefault || sg.StagingDefault) && !exported[name] {
+			log.Println("Warning: security group " + name + " is a platform default on target only, leaving it unchanged.")
+		}
+	}
+}
+
+//ruleDiff returns the rules of a missing from b, formatted for the import log
+func ruleDiff(a apihelper.Rules, b apihelper.Rules) []string {
+	existing := make(map[string]bool)
+	for _, r := range b {
+		existing[fmt.Sprintf("%s %s %s", r.Protocol, r.Destination, r.Ports)] = true
+	}
+	var diff []string
+	for _, r := range a {
+		rule := fmt.Sprintf("%s %s %s", r.Protocol, r.Destination, r.Ports)
+		if !existing[rule] {
+			diff = append(diff, rule)
+		}
+	}
+	return diff
+}
+
+func toAPISecurityGroup(sg SecurityGroup) apihelper.SecurityGroup {
+	rules := apihelper.Rules{}
+	for _, r := range sg.Rules {
+		rules = append(rules, apihelper.Rule{
+			Description: r.Description,
+			Destination: r.Destination,
+			Log:         r.Log,
+			Ports:       r.Ports,
+			Protocol:    r.Protocol,
+		})
+	}
+	return apihelper.SecurityGroup{
+		Name:           sg.Name,
+		Rules:          rules,
+		RunningDefault: sg.RunningDefault,
+		StagingDefault: sg.StagingDefault,
+	}
+}
+
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -339,18 +1779,76 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func writeToJson(orgs Orgs) {
-	b, _ := json.MarshalIndent(orgs, "", "\t")
-	err := ioutil.WriteFile("apps.json", b, 0644)
+func writeToJson(orgs Orgs, platformConfig *PlatformConfig) {
+	var b []byte
+	var mode os.FileMode = 0644
+	if nil == platformConfig {
+		b, _ = json.MarshalIndent(orgs, "", "\t")
+	} else {
+		b, _ = json.MarshalIndent(Export{PlatformConfig: platformConfig, Orgs: orgs}, "", "\t")
+		// the environment variable groups usually hold platform credentials
+		mode = 0600
+	}
+	err := ioutil.WriteFile("apps.json", b, mode)
+	check(err)
+	err = os.Chmod("apps.json", mode)
 	check(err)
 }
-func readToJson() Orgs {
+
+//readToJson reads apps.json, which is either a list of orgs or an Export with the platform configuration
+func readToJson() (Orgs, *PlatformConfig) {
 	var orgs Orgs
 	b, err := ioutil.ReadFile("apps.json")
 	check(err)
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		var export Export
+		err = json.Unmarshal(b, &export)
+		check(err)
+		return export.Orgs, export.PlatformConfig
+	}
 	err = json.Unmarshal(b, &orgs)
 	check(err)
-	return orgs
+	return orgs, nil
+}
+
+//readJsonFile reads the JSON file supplied with an import flag into v
+func readJsonFile(filename string, v interface{}) {
+	b, err := ioutil.ReadFile(filename)
+	check(err)
+	err = json.Unmarshal(b, v)
+	check(err)
+}
+
+//readUserMappings reads a JSON object keyed by source username, e.g.
+//{"jdoe": {"Username": "john.doe@example.com", "Origin": "ldap"}}
+func readUserMappings(filename string) UserMappings {
+	var mappings UserMappings
+	readJsonFile(filename, &mappings)
+	return mappings
+}
+
+//readServiceOverrides reads provisioning parameters keyed by org/space/instance, e.g.
+//{"Central/dev/orders-db": {"storage_gb": 20}}
+func readServiceOverrides(filename string) ServiceOverrides {
+	var overrides ServiceOverrides
+	readJsonFile(filename, &overrides)
+	return overrides
+}
+
+//readBrokerPasswords reads service broker passwords keyed by org/space/broker, e.g.
+//{"Central/dev/my-broker": "secret"}
+func readBrokerPasswords(filename string) BrokerPasswords {
+	var passwords BrokerPasswords
+	readJsonFile(filename, &passwords)
+	return passwords
+}
+
+//readVolumeSecrets reads volume service bind secrets keyed by org/space/app/instance, e.g.
+//{"Central/dev/orders/orders-nfs": {"uid": "1000", "gid": "1000"}}
+func readVolumeSecrets(filename string) VolumeSecrets {
+	var secrets VolumeSecrets
+	readJsonFile(filename, &secrets)
+	return secrets
 }
 
 func check(e error) {